@@ -0,0 +1,240 @@
+package piper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditStreams says how much Audit records of a command's stdin, stdout
+// and stderr.
+type AuditStreams int
+
+const (
+	// AuditCounts records just the number of bytes in each stream.
+	AuditCounts AuditStreams = iota
+	// AuditHashes also records the SHA-256 of each stream.
+	AuditHashes
+	// AuditContent also records the content of each stream.
+	AuditContent
+)
+
+type (
+	// Audit wraps an existing launcher to record what it does, and what any
+	// Executor it builds does, as JSON lines written to W, one AuditRecord
+	// per line.  Writes to W are serialized, even across Audit launchers.
+	Audit struct {
+		Launcher
+		W       io.Writer
+		Streams AuditStreams
+	}
+
+	// AuditRecord describes one action taken by an Audit launcher or one
+	// of its executors.
+	AuditRecord struct {
+		Time     time.Time `json:"time"`
+		Launcher string    `json:"launcher"`
+		// Event is one of launch, run, start, wait, kill or close.
+		Event   string `json:"event"`
+		Command string `json:"command,omitempty"`
+		Error   string `json:"error,omitempty"`
+		// ExitStatus is only present for run and wait, and is as returned
+		// by the ExitStatus function.
+		ExitStatus *int `json:"exit_status,omitempty"`
+		// Streams is only present for run and wait, and describes any of
+		// stdin, stdout and stderr that were piped.
+		Streams map[string]AuditStream `json:"streams,omitempty"`
+	}
+
+	// AuditStream describes what passed through one of a command's pipes.
+	// Content is base64 in JSON, so binary data survives the round trip.
+	AuditStream struct {
+		Bytes   int64  `json:"bytes"`
+		SHA256  string `json:"sha256,omitempty"`
+		Content []byte `json:"content,omitempty"`
+	}
+
+	// auditexe is a wrapping executor that records what it's doing.
+	auditexe struct {
+		Executor
+		Audit
+		taps map[string]*tap
+	}
+
+	// tap observes the data passing through a pipe.
+	tap struct {
+		n       int64
+		h       hash.Hash
+		content *bytes.Buffer
+	}
+
+	tapReader struct {
+		io.ReadCloser
+		*tap
+	}
+
+	tapWriter struct {
+		io.WriteCloser
+		*tap
+	}
+)
+
+// auditMu serializes writes of audit records.  It's shared by all Audit
+// launchers since they're values, often copied, and may share a W.
+var auditMu sync.Mutex
+
+// NewAudit returns an Audit launcher wrapping lch and writing to w.
+func NewAudit(lch Launcher, w io.Writer, streams AuditStreams) Audit {
+	return Audit{Launcher: lch, W: w, Streams: streams}
+}
+
+// record writes ar to a.W, filling in the time and launcher.  Write errors
+// are ignored since there's no good way to report them.
+func (a Audit) record(ar AuditRecord) {
+	ar.Time, ar.Launcher = time.Now(), a.Launcher.String()
+	b, err := json.Marshal(ar)
+	if err != nil {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	a.W.Write(append(b, '\n'))
+}
+
+func errstr(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Launch implements Launcher.
+func (a Audit) Launch(cmd string) (Executor, error) {
+	exe, err := a.Launcher.Launch(cmd)
+	a.record(AuditRecord{Event: "launch", Command: cmd, Error: errstr(err)})
+	if err != nil {
+		return nil, err
+	}
+	return &auditexe{exe, a, make(map[string]*tap)}, nil
+}
+
+// Close implements Launcher.
+func (a Audit) Close() error {
+	err := a.Launcher.Close()
+	a.record(AuditRecord{Event: "close", Error: errstr(err)})
+	return err
+}
+
+func (ae *auditexe) newTap(name string) *tap {
+	t := &tap{}
+	if ae.Streams >= AuditHashes {
+		t.h = sha256.New()
+	}
+	if ae.Streams >= AuditContent {
+		t.content = &bytes.Buffer{}
+	}
+	ae.taps[name] = t
+	return t
+}
+
+func (t *tap) observe(p []byte) {
+	t.n += int64(len(p))
+	if t.h != nil {
+		t.h.Write(p)
+	}
+	if t.content != nil {
+		t.content.Write(p)
+	}
+}
+
+func (tr tapReader) Read(p []byte) (int, error) {
+	n, err := tr.ReadCloser.Read(p)
+	tr.observe(p[:n])
+	return n, err
+}
+
+func (tw tapWriter) Write(p []byte) (int, error) {
+	n, err := tw.WriteCloser.Write(p)
+	tw.observe(p[:n])
+	return n, err
+}
+
+// StdinPipe implements Executor.
+func (ae *auditexe) StdinPipe() (io.WriteCloser, error) {
+	w, err := ae.Executor.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	return tapWriter{w, ae.newTap("stdin")}, nil
+}
+
+// StdoutPipe implements Executor.
+func (ae *auditexe) StdoutPipe() (io.ReadCloser, error) {
+	r, err := ae.Executor.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	return tapReader{r, ae.newTap("stdout")}, nil
+}
+
+// StderrPipe implements Executor.
+func (ae *auditexe) StderrPipe() (io.ReadCloser, error) {
+	r, err := ae.Executor.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	return tapReader{r, ae.newTap("stderr")}, nil
+}
+
+// finished records the completion of the command with err.
+func (ae *auditexe) finished(event string, err error) {
+	status := ExitStatus(err)
+	ar := AuditRecord{Event: event, Command: ae.Command(), Error: errstr(err), ExitStatus: &status}
+	if len(ae.taps) > 0 {
+		ar.Streams = make(map[string]AuditStream)
+	}
+	for name, t := range ae.taps {
+		as := AuditStream{Bytes: t.n}
+		if t.h != nil {
+			as.SHA256 = hex.EncodeToString(t.h.Sum(nil))
+		}
+		if t.content != nil {
+			as.Content = t.content.Bytes()
+		}
+		ar.Streams[name] = as
+	}
+	ae.record(ar)
+}
+
+// Run implements Executor.
+func (ae *auditexe) Run() error {
+	err := ae.Executor.Run()
+	ae.finished("run", err)
+	return err
+}
+
+// Start implements Executor.
+func (ae *auditexe) Start() error {
+	err := ae.Executor.Start()
+	ae.record(AuditRecord{Event: "start", Command: ae.Command(), Error: errstr(err)})
+	return err
+}
+
+// Wait implements Executor.
+func (ae *auditexe) Wait() error {
+	err := ae.Executor.Wait()
+	ae.finished("wait", err)
+	return err
+}
+
+// Kill implements Executor.
+func (ae *auditexe) Kill() error {
+	err := ae.Executor.Kill()
+	ae.record(AuditRecord{Event: "kill", Command: ae.Command(), Error: errstr(err)})
+	return err
+}
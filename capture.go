@@ -0,0 +1,68 @@
+package piper
+
+import "fmt"
+
+// capture is a writer that stores what it's given.  If limit is positive,
+// only the first and last limit bytes are kept, and dropped counts the bytes
+// discarded in between.
+type capture struct {
+	limit int
+	head  []byte
+	// tail is a ring buffer holding the most recent bytes written after
+	// head filled up, the oldest of them at tail[start] once it's full.
+	tail    []byte
+	start   int
+	dropped int64
+}
+
+func newCapture(limit int) *capture {
+	return &capture{limit: limit}
+}
+
+// Write implements io.Writer.
+func (c *capture) Write(p []byte) (int, error) {
+	n := len(p)
+	if c.limit <= 0 {
+		c.head = append(c.head, p...)
+		return n, nil
+	}
+
+	if room := c.limit - len(c.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		c.head = append(c.head, p[:room]...)
+		p = p[room:]
+	}
+
+	// Only the last limit bytes of p can survive.
+	if len(p) > c.limit {
+		c.dropped += int64(len(p) - c.limit)
+		p = p[len(p)-c.limit:]
+	}
+	if room := c.limit - len(c.tail); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		c.tail = append(c.tail, p[:room]...)
+		p = p[room:]
+	}
+	// The tail is full, so overwrite its oldest bytes.
+	for len(p) > 0 {
+		m := copy(c.tail[c.start:], p)
+		c.dropped += int64(m)
+		c.start = (c.start + m) % c.limit
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// String returns the captured bytes, with a marker standing in for any that
+// were dropped.
+func (c *capture) String() string {
+	tail := string(c.tail[c.start:]) + string(c.tail[:c.start])
+	if c.dropped == 0 {
+		return string(c.head) + tail
+	}
+	return fmt.Sprintf("%s\n[... %d bytes dropped ...]\n%s", c.head, c.dropped, tail)
+}
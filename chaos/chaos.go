@@ -0,0 +1,354 @@
+// Package chaos provides a piper.Launcher wrapper that injects faults into
+// the Executors of any other Launcher, local or ssh, so that code built on
+// piper can be tested against partial failures.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/piper"
+)
+
+// ErrInjected is wrapped by every error chaos injects.
+var ErrInjected = errors.New("injected fault")
+
+type (
+	// Policy says which faults to inject and how often.  Probabilities
+	// range from 0 (never) to 1 (always).
+	Policy struct {
+		// Seed seeds the random choices, so a failing run can be
+		// reproduced, at least as far as goroutine scheduling allows.
+		Seed int64
+		// Errors gives the probability of each method returning an
+		// error instead of doing its job, keyed by method name: Launch,
+		// Start, Run, Wait, Kill, StdinPipe, StdoutPipe or StderrPipe.
+		Errors map[string]float64
+		// HangWait is the probability of Wait blocking until Kill is
+		// called, as if the command were stuck.
+		HangWait float64
+		// Streams gives faults for each of stdin, stdout and stderr.
+		Streams map[string]StreamFaults
+	}
+
+	// StreamFaults describes faults injected into one of a command's
+	// streams.  Each is decided per Read or Write, except Truncate which
+	// is decided once per stream.
+	StreamFaults struct {
+		// Truncate is the probability of the command dying after a
+		// random number of bytes, up to TruncateAfter, have passed
+		// through this stream.  The command is killed, reads see EOF
+		// and writes fail.
+		Truncate      float64
+		TruncateAfter int64
+		// Corrupt is the probability of one byte being altered.
+		Corrupt float64
+		// Stall is the probability of pausing for up to StallFor first.
+		Stall    float64
+		StallFor time.Duration
+	}
+
+	// Launcher wraps an existing launcher to inject faults per Policy.
+	// Create it with New.
+	Launcher struct {
+		piper.Launcher
+		Policy Policy
+		rng    *lockedRand
+	}
+
+	lockedRand struct {
+		mu sync.Mutex
+		r  *rand.Rand
+	}
+
+	// exe wraps an Executor to inject faults.
+	exe struct {
+		piper.Executor
+		l        Launcher
+		hang     bool
+		killed   chan struct{}
+		killonce sync.Once
+		// pipes are the underlying pipes opened, which we must close if
+		// we fail Start.
+		pipes []io.Closer
+		// started is set once the underlying command has been started;
+		// only then can Wait hang.
+		started bool
+	}
+
+	// stream injects faults into a pipe.
+	stream struct {
+		e    *exe
+		name string
+		f    StreamFaults
+		// limit is the number of bytes after which the command dies, or
+		// negative if it won't.
+		limit int64
+		n     int64
+		// dead is set once truncation has killed the command.
+		dead bool
+	}
+
+	reader struct {
+		io.ReadCloser
+		*stream
+	}
+
+	writer struct {
+		io.WriteCloser
+		*stream
+	}
+)
+
+// methods are the names Policy.Errors may use, and streams those
+// Policy.Streams may use.
+var (
+	methods = []string{"Launch", "Start", "Run", "Wait", "Kill", "StdinPipe", "StdoutPipe", "StderrPipe"}
+	streams = []string{"stdin", "stdout", "stderr"}
+)
+
+// New returns a Launcher wrapping lch which injects faults per p.  It's an
+// error for p to name an unknown method or stream, so that a typo doesn't
+// silently disable a fault.
+func New(lch piper.Launcher, p Policy) (Launcher, error) {
+	for m := range p.Errors {
+		if !contains(methods, m) {
+			return Launcher{}, fmt.Errorf("chaos: unknown method %q, expected one of %v", m, methods)
+		}
+	}
+	for s := range p.Streams {
+		if !contains(streams, s) {
+			return Launcher{}, fmt.Errorf("chaos: unknown stream %q, expected one of %v", s, streams)
+		}
+	}
+	return Launcher{Launcher: lch, Policy: p, rng: &lockedRand{r: rand.New(rand.NewSource(p.Seed))}}, nil
+}
+
+// contains returns true if ss includes s.
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (lr *lockedRand) float64() float64 {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.Float64()
+}
+
+func (lr *lockedRand) int63n(n int64) int64 {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.Int63n(n)
+}
+
+// chance returns true with probability p.
+func (l Launcher) chance(p float64) bool {
+	return p > 0 && l.rng.float64() < p
+}
+
+// fail returns an injected error for method with the probability the policy
+// gives, otherwise nil.
+func (l Launcher) fail(method string) error {
+	if l.chance(l.Policy.Errors[method]) {
+		return fmt.Errorf("chaos %s: %w", method, ErrInjected)
+	}
+	return nil
+}
+
+// Launch implements piper.Launcher.
+func (l Launcher) Launch(cmd string) (piper.Executor, error) {
+	if err := l.fail("Launch"); err != nil {
+		return nil, err
+	}
+	e, err := l.Launcher.Launch(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &exe{Executor: e, l: l, hang: l.chance(l.Policy.HangWait), killed: make(chan struct{})}, nil
+}
+
+func (e *exe) newStream(name string) *stream {
+	s := &stream{e: e, name: name, f: e.l.Policy.Streams[name], limit: -1}
+	if e.l.chance(s.f.Truncate) {
+		s.limit = 0
+		if s.f.TruncateAfter > 0 {
+			s.limit = e.l.rng.int63n(s.f.TruncateAfter + 1)
+		}
+	}
+	return s
+}
+
+// before applies the per-call faults to a Read or Write of p, returning how
+// much of p may be transferred before the stream is truncated.
+func (s *stream) before(p []byte) int {
+	if s.e.l.chance(s.f.Stall) && s.f.StallFor > 0 {
+		time.Sleep(time.Duration(s.e.l.rng.int63n(int64(s.f.StallFor))))
+	}
+	if s.limit >= 0 && s.n+int64(len(p)) > s.limit {
+		return int(s.limit - s.n)
+	}
+	return len(p)
+}
+
+// corrupt alters a byte of p with the probability the policy gives.
+func (s *stream) corrupt(p []byte) {
+	if len(p) > 0 && s.e.l.chance(s.f.Corrupt) {
+		p[s.e.l.rng.int63n(int64(len(p)))] ^= 0xff
+	}
+}
+
+// truncated kills the command once the stream has reached its limit.
+func (s *stream) truncated() bool {
+	if s.limit >= 0 && s.n >= s.limit {
+		s.e.Kill()
+		return true
+	}
+	return false
+}
+
+func (r reader) Read(p []byte) (int, error) {
+	if r.dead {
+		return 0, io.EOF
+	}
+	m := r.before(p)
+	if m == 0 && r.truncated() {
+		// Killing the command may not kill all of its children, so
+		// drain what they write lest they block.
+		r.dead = true
+		go io.Copy(ioutil.Discard, r.ReadCloser)
+		return 0, io.EOF
+	}
+	n, err := r.ReadCloser.Read(p[:m])
+	r.n += int64(n)
+	r.corrupt(p[:n])
+	return n, err
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	if w.dead {
+		return 0, fmt.Errorf("chaos %s truncated: %w", w.name, ErrInjected)
+	}
+	m := w.before(p)
+	if m == 0 && w.truncated() {
+		w.dead = true
+		w.WriteCloser.Close()
+		return 0, fmt.Errorf("chaos %s truncated: %w", w.name, ErrInjected)
+	}
+	buf := append([]byte(nil), p[:m]...)
+	w.corrupt(buf)
+	n, err := w.WriteCloser.Write(buf)
+	w.n += int64(n)
+	if err == nil && n < len(p) {
+		err = fmt.Errorf("chaos %s truncated: %w", w.name, ErrInjected)
+		w.truncated()
+		w.dead = true
+		w.WriteCloser.Close()
+	}
+	return n, err
+}
+
+// StdinPipe implements piper.Executor.
+func (e *exe) StdinPipe() (io.WriteCloser, error) {
+	if err := e.l.fail("StdinPipe"); err != nil {
+		return nil, err
+	}
+	w, err := e.Executor.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	e.pipes = append(e.pipes, w)
+	return writer{w, e.newStream("stdin")}, nil
+}
+
+// StdoutPipe implements piper.Executor.
+func (e *exe) StdoutPipe() (io.ReadCloser, error) {
+	if err := e.l.fail("StdoutPipe"); err != nil {
+		return nil, err
+	}
+	r, err := e.Executor.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	e.pipes = append(e.pipes, r)
+	return reader{r, e.newStream("stdout")}, nil
+}
+
+// StderrPipe implements piper.Executor.
+func (e *exe) StderrPipe() (io.ReadCloser, error) {
+	if err := e.l.fail("StderrPipe"); err != nil {
+		return nil, err
+	}
+	r, err := e.Executor.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	e.pipes = append(e.pipes, r)
+	return reader{r, e.newStream("stderr")}, nil
+}
+
+// Start implements piper.Executor.  Like a real failed Start, an injected
+// failure closes any pipes that were opened.
+func (e *exe) Start() error {
+	if err := e.l.fail("Start"); err != nil {
+		for _, c := range e.pipes {
+			c.Close()
+		}
+		return err
+	}
+	if err := e.Executor.Start(); err != nil {
+		return err
+	}
+	e.started = true
+	return nil
+}
+
+// Run implements piper.Executor.  Like an injected Start failure, an
+// injected failure closes any pipes that were opened, and it releases the
+// underlying command.
+func (e *exe) Run() error {
+	if err := e.l.fail("Run"); err != nil {
+		for _, c := range e.pipes {
+			c.Close()
+		}
+		e.Executor.Wait()
+		return err
+	}
+	return e.Executor.Run()
+}
+
+// Wait implements piper.Executor.  An injected error is returned only after
+// the real Wait, so as not to leak resources.
+func (e *exe) Wait() error {
+	if e.hang && e.started {
+		<-e.killed
+	}
+	err := e.Executor.Wait()
+	if ierr := e.l.fail("Wait"); ierr != nil {
+		return ierr
+	}
+	if e.hang && e.started && err == nil {
+		// The real command may well have exited before the kill, but
+		// a hung one wouldn't have.
+		return fmt.Errorf("chaos Wait: killed while hung: %w", ErrInjected)
+	}
+	return err
+}
+
+// Kill implements piper.Executor.
+func (e *exe) Kill() error {
+	e.killonce.Do(func() { close(e.killed) })
+	if err := e.l.fail("Kill"); err != nil {
+		return err
+	}
+	return e.Executor.Kill()
+}
@@ -0,0 +1,130 @@
+package chaos
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/piper"
+	"github.com/ncabatoff/piper/local"
+)
+
+// Verify implementation of Executor and Launcher interfaces.
+func TestInterfaces(t *testing.T) {
+	_ = piper.Launcher(Launcher{})
+	_ = piper.Executor(&exe{})
+}
+
+// newLauncher returns a Launcher wrapping local.Launcher per p.
+func newLauncher(t *testing.T, p Policy) Launcher {
+	l, err := New(local.Launcher{}, p)
+	if err != nil {
+		t.Fatalf("error creating launcher: %v", err)
+	}
+	return l
+}
+
+func TestChaosErrors(t *testing.T) {
+	for _, method := range []string{"Launch", "Start", "Wait", "StdoutPipe"} {
+		l := newLauncher(t, Policy{Errors: map[string]float64{method: 1}})
+		if _, _, err := piper.RunCmdCapture(l, "true"); !errors.Is(err, ErrInjected) {
+			t.Errorf("%s: expected injected error, got %v", method, err)
+		}
+	}
+	l := newLauncher(t, Policy{Errors: map[string]float64{"Start": 0}})
+	if err := piper.RunCmd(l, "true"); err != nil {
+		t.Errorf("expected no injected error, got %v", err)
+	}
+}
+
+// waitCounter counts the Waits on the executors it launches.
+type waitCounter struct {
+	piper.Launcher
+	waits *int
+}
+
+type waitCounterExe struct {
+	piper.Executor
+	waits *int
+}
+
+func (l waitCounter) Launch(cmd string) (piper.Executor, error) {
+	e, err := l.Launcher.Launch(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return waitCounterExe{e, l.waits}, nil
+}
+
+func (e waitCounterExe) Wait() error {
+	*e.waits++
+	return e.Executor.Wait()
+}
+
+func TestChaosRun(t *testing.T) {
+	var waits int
+	l, err := New(waitCounter{local.Launcher{}, &waits}, Policy{Errors: map[string]float64{"Run": 1}})
+	if err != nil {
+		t.Fatalf("error creating launcher: %v", err)
+	}
+	exe, err := l.Launch("true")
+	if err != nil {
+		t.Fatalf("error launching: %v", err)
+	}
+	if err := exe.Run(); !errors.Is(err, ErrInjected) {
+		t.Errorf("expected injected error, got %v", err)
+	}
+	if waits != 1 {
+		t.Errorf("expected the command to be released, got %d waits", waits)
+	}
+}
+
+func TestChaosUnknownNames(t *testing.T) {
+	for _, p := range []Policy{
+		{Errors: map[string]float64{"start": 1}},
+		{Streams: map[string]StreamFaults{"stdot": {Corrupt: 1}}},
+	} {
+		if _, err := New(local.Launcher{}, p); err == nil {
+			t.Errorf("expected error for policy %+v", p)
+		}
+	}
+}
+
+func TestChaosTruncate(t *testing.T) {
+	policy := Policy{Seed: 1, Streams: map[string]StreamFaults{"stdout": {Truncate: 1, TruncateAfter: 1000}}}
+	var lengths []int
+	for i := 0; i < 2; i++ {
+		l := newLauncher(t, policy)
+		pr := piper.Pipe(piper.Launchable{Launcher: l, Cmd: "seq 1 100000"}, piper.Launchable{Launcher: local.Launcher{}, Cmd: "cat"})
+		if pr.Err == nil {
+			t.Errorf("expected truncated source to fail")
+		}
+		if len(pr.SnkStdout) > 1000 {
+			t.Errorf("expected at most 1000 bytes, got %d", len(pr.SnkStdout))
+		}
+		lengths = append(lengths, len(pr.SnkStdout))
+	}
+	if lengths[0] != lengths[1] {
+		t.Errorf("same seed gave different truncations: %v", lengths)
+	}
+}
+
+func TestChaosCorrupt(t *testing.T) {
+	l := newLauncher(t, Policy{Streams: map[string]StreamFaults{"stdin": {Corrupt: 1}}})
+	stdout, _, err := piper.RunCmdStrInCapture(l, "cat", "hello")
+	if err != nil || stdout == "hello" || len(stdout) != 5 {
+		t.Errorf("expected corrupted hello, got %q, %v", stdout, err)
+	}
+}
+
+func TestChaosHangWait(t *testing.T) {
+	l := newLauncher(t, Policy{HangWait: 1})
+	start := time.Now()
+	rr := piper.RunCmdWith(l, "true", piper.RunOptions{Timeout: 50 * time.Millisecond})
+	if rr.Err == nil {
+		t.Errorf("expected hung command to be killed")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Wait didn't hang")
+	}
+}
@@ -0,0 +1,95 @@
+package piper
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+type (
+	// meter is a writer that counts and optionally hashes what it's given,
+	// reporting the count so far to progress if non-nil.
+	meter struct {
+		n        int64
+		h        hash.Hash
+		progress func(int64)
+	}
+
+	// Verify gives commands used to check that the sink received what the
+	// source sent, e.g. "sha256sum < /src/file" and "sha256sum < /dst/file".
+	// Each must print a digest as the first word of its output.
+	Verify struct {
+		SrcCmd string
+		SnkCmd string
+	}
+)
+
+func newMeter(newhash func() hash.Hash, progress func(int64)) *meter {
+	m := &meter{progress: progress}
+	if newhash != nil {
+		m.h = newhash()
+	}
+	return m
+}
+
+// Write implements io.Writer.
+func (m *meter) Write(p []byte) (int, error) {
+	m.n += int64(len(p))
+	if m.h != nil {
+		m.h.Write(p)
+	}
+	if m.progress != nil {
+		m.progress(m.n)
+	}
+	return len(p), nil
+}
+
+// digest returns the hex encoded hash, or "" if we're not hashing.
+func (m *meter) digest() string {
+	if m.h == nil {
+		return ""
+	}
+	return hex.EncodeToString(m.h.Sum(nil))
+}
+
+// digestOf runs cmd using lch and returns the first word of its output.
+func digestOf(lch Launcher, cmd string) (string, error) {
+	stdout, stderr, err := RunCmdCapture(lch, cmd)
+	if err != nil {
+		return "", lch.Errorf("verification command failed: %v; stderr: %s", err, stderr)
+	}
+	f := strings.Fields(stdout)
+	if len(f) == 0 {
+		return "", lch.Errorf("verification command %q produced no digest", cmd)
+	}
+	return f[0], nil
+}
+
+// check runs the verification commands and compares their digests to each
+// other and, if it's comparable, to the digest computed by the pipe.  It's
+// comparable when Hash was set and we didn't only see compressed data; the
+// caller is responsible for Hash and the commands agreeing on an algorithm.
+func (v Verify) check(srclch, snklch Launcher, pr PipeResult, opts PipeOptions) error {
+	srcsum, err := digestOf(srclch, v.SrcCmd)
+	if err != nil {
+		return err
+	}
+	snksum, err := digestOf(snklch, v.SnkCmd)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(srcsum, snksum) {
+		return fmt.Errorf("checksum mismatch: source %s, sink %s", srcsum, snksum)
+	}
+	if pr.Digest != "" && !opts.sawCompressed() && !strings.EqualFold(pr.Digest, srcsum) {
+		return fmt.Errorf("checksum mismatch: source and sink %s, piped %s", srcsum, pr.Digest)
+	}
+	return nil
+}
+
+// sawCompressed returns true if the data passing through our process is
+// compressed, i.e. the source host compresses and we don't decompress.
+func (opts PipeOptions) sawCompressed() bool {
+	return opts.Codec != nil && !opts.CompressHere && !opts.DecompressHere
+}
@@ -0,0 +1,269 @@
+// Command piper runs commands and pipes between them, locally or over ssh.
+//
+// Usage:
+//
+//	piper [flags] run HOST -- CMD...
+//	piper [flags] capture HOST -- CMD...
+//	piper [flags] pipe SRCHOST:SRCCMD DSTHOST:DSTCMD
+//
+// HOST is "local" or an ssh target of the form [user@]host[:port].  CMD
+// words are joined with spaces and run by the host's shell.  run
+// copies the command's stdout to ours as it arrives; capture instead prints
+// a JSON object giving its stdout, stderr and exit status.  pipe feeds the
+// stdout of SRCCMD into DSTCMD, and copies DSTCMD's stdout to ours as it
+// arrives.  Each line a command writes to stderr is copied to ours,
+// prefixed with its stage and host.
+//
+// ssh hosts must have their keys listed in -known-hosts, by default
+// ~/.ssh/known_hosts, unless -insecure-ignore-host-key is given.
+//
+// The exit status says what failed:
+//
+//	0  success
+//	1  anything not covered below, e.g. copying between the commands
+//	2  bad usage
+//	3  a host couldn't be reached or a command couldn't be started
+//	4  the command (run, capture) or source command (pipe) failed
+//	5  the sink command failed
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ncabatoff/piper"
+	"github.com/ncabatoff/piper/local"
+	"github.com/ncabatoff/piper/ssh"
+)
+
+const (
+	exitOK = iota
+	exitFailed
+	exitUsage
+	exitConnect
+	exitSource
+	exitSink
+)
+
+// exitCmd is the status for a failed run or capture command.
+const exitCmd = exitSource
+
+// pipeCaptureLimit bounds what pipe keeps of output it has already passed on,
+// which is only needed for error messages.
+const pipeCaptureLimit = 4 << 10
+
+type (
+	// cli holds the global flags and where output goes.
+	cli struct {
+		keyfile    string
+		knownHosts string
+		insecure   bool
+		timeout    time.Duration
+		stdin      bool
+		stdout     io.Writer
+		stderr     io.Writer
+		input      io.Reader
+	}
+
+	// captureOutput is what capture prints.
+	captureOutput struct {
+		Stdout     string `json:"stdout"`
+		Stderr     string `json:"stderr"`
+		ExitStatus int    `json:"exit_status"`
+		Error      string `json:"error,omitempty"`
+	}
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes the command line args and returns the exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := cli{stdout: stdout, stderr: stderr, input: stdin}
+	fs := flag.NewFlagSet("piper", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&c.keyfile, "key", sshFile("id_rsa"), "private key file for ssh hosts")
+	fs.StringVar(&c.knownHosts, "known-hosts", sshFile("known_hosts"), "file listing the host keys of ssh hosts")
+	fs.BoolVar(&c.insecure, "insecure-ignore-host-key", false, "don't check the host keys of ssh hosts")
+	fs.DurationVar(&c.timeout, "timeout", 0, "kill run and capture commands after this long")
+	fs.BoolVar(&c.stdin, "stdin", false, "feed our stdin to run and capture commands")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage:\n"+
+			"  piper [flags] run HOST -- CMD...\n"+
+			"  piper [flags] capture HOST -- CMD...\n"+
+			"  piper [flags] pipe SRCHOST:SRCCMD DSTHOST:DSTCMD\n"+
+			"HOST is \"local\" or [user@]host[:port]\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	switch args[0] {
+	case "run", "capture":
+		if len(args) < 4 || args[2] != "--" {
+			fs.Usage()
+			return exitUsage
+		}
+		return c.run(args[1], strings.Join(args[3:], " "), args[0] == "capture")
+	case "pipe":
+		if len(args) != 3 {
+			fs.Usage()
+			return exitUsage
+		}
+		src, err := splitHostCmd(args[1])
+		if err == nil {
+			var snk [2]string
+			if snk, err = splitHostCmd(args[2]); err == nil {
+				return c.pipe(src, snk)
+			}
+		}
+		fmt.Fprintf(stderr, "piper: %v\n", err)
+		return exitUsage
+	}
+	fmt.Fprintf(stderr, "piper: unknown subcommand %q\n", args[0])
+	fs.Usage()
+	return exitUsage
+}
+
+// sshFile returns ~/.ssh/name, or "" if we don't know ~.
+func sshFile(name string) string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(u.HomeDir, ".ssh", name)
+}
+
+// splitHostCmd splits HOST:CMD into host and command.  The first colon
+// ends the host unless it's followed by a port number and another colon,
+// so user@host:2222:cmd works as expected.
+func splitHostCmd(s string) ([2]string, error) {
+	start := 0
+	if b, c := strings.Index(s, "["), strings.Index(s, ":"); b >= 0 && (c < 0 || b < c) {
+		// A bracketed IPv6 literal: look for the colon after it.
+		start = strings.Index(s, "]")
+		if start < 0 {
+			return [2]string{}, fmt.Errorf("no closing bracket in %q", s)
+		}
+	}
+	i := strings.Index(s[start:], ":")
+	if i < 0 {
+		return [2]string{}, fmt.Errorf("expected HOST:CMD, got %q", s)
+	}
+	host, cmd := s[:start+i], s[start+i+1:]
+	if j := strings.Index(cmd, ":"); j > 0 && strings.Trim(cmd[:j], "0123456789") == "" {
+		host, cmd = host+":"+cmd[:j], cmd[j+1:]
+	}
+	if host == "" || cmd == "" {
+		return [2]string{}, fmt.Errorf("expected HOST:CMD, got %q", s)
+	}
+	return [2]string{host, cmd}, nil
+}
+
+// launcher returns a Launcher for host.
+func (c cli) launcher(host string) (piper.Launcher, error) {
+	if host == "local" {
+		return local.Launcher{}, nil
+	}
+	if c.insecure {
+		return ssh.Dial(host, c.keyfile)
+	}
+	hostKey, err := ssh.KnownHosts(c.knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.DialWith(host, c.keyfile, hostKey)
+}
+
+// stderrFunc copies each line to our stderr with its stage and host.
+func (c cli) stderrFunc(l piper.StderrLine) {
+	fmt.Fprintf(c.stderr, "[%s %s] %s\n", l.Stage, l.Launcher, l.Text)
+}
+
+// run implements the run and capture subcommands.
+func (c cli) run(host, cmd string, capture bool) int {
+	lch, err := c.launcher(host)
+	if err != nil {
+		fmt.Fprintf(c.stderr, "piper: %v\n", err)
+		return exitConnect
+	}
+	defer lch.Close()
+
+	opts := piper.RunOptions{Capture: capture, Timeout: c.timeout}
+	if !capture {
+		opts.Stdout, opts.StderrFunc = c.stdout, c.stderrFunc
+	}
+	if c.stdin {
+		opts.StdinReader = c.input
+	}
+
+	rr := piper.RunCmdWith(lch, cmd, opts)
+	if capture {
+		out := captureOutput{Stdout: rr.Stdout, Stderr: rr.Stderr}
+		if rr.Err != nil {
+			out.ExitStatus, out.Error = piper.ExitStatus(rr.Err), rr.Err.Error()
+		}
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	}
+
+	switch {
+	case rr.Err == nil:
+		return exitOK
+	case piper.IsStartError(rr.Err):
+		fmt.Fprintf(c.stderr, "piper: %v\n", rr.Err)
+		return exitConnect
+	default:
+		fmt.Fprintf(c.stderr, "piper: %v\n", rr.Err)
+		return exitCmd
+	}
+}
+
+// pipe implements the pipe subcommand.
+func (c cli) pipe(src, snk [2]string) int {
+	srclch, err := c.launcher(src[0])
+	if err != nil {
+		fmt.Fprintf(c.stderr, "piper: source: %v\n", err)
+		return exitConnect
+	}
+	defer srclch.Close()
+	snklch, err := c.launcher(snk[0])
+	if err != nil {
+		fmt.Fprintf(c.stderr, "piper: sink: %v\n", err)
+		return exitConnect
+	}
+	defer snklch.Close()
+
+	pr := piper.PipeWith(piper.Launchable{Launcher: srclch, Cmd: src[1]},
+		piper.Launchable{Launcher: snklch, Cmd: snk[1]},
+		piper.PipeOptions{StderrFunc: c.stderrFunc, Stdout: c.stdout, CaptureLimit: pipeCaptureLimit})
+	if pr.Err == nil {
+		return exitOK
+	}
+	fmt.Fprintf(c.stderr, "piper: %v\n", pr.Err)
+	switch {
+	case piper.IsStartError(pr.Err):
+		return exitConnect
+	case pr.SnkErr != nil:
+		return exitSink
+	case pr.SrcErr != nil:
+		return exitSource
+	default:
+		return exitFailed
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ncabatoff/piper/test"
+)
+
+func TestSplitHostCmd(t *testing.T) {
+	for _, tc := range []struct {
+		in, host, cmd string
+	}{
+		{"local:echo hi", "local", "echo hi"},
+		{"local:echo a:b", "local", "echo a:b"},
+		{"bob@example.com:cat", "bob@example.com", "cat"},
+		{"bob@example.com:2222:cat", "bob@example.com:2222", "cat"},
+		{"bob@[::1]:2222:cat > x", "bob@[::1]:2222", "cat > x"},
+		{"local:[ -f x ] && cat x", "local", "[ -f x ] && cat x"},
+	} {
+		got, err := splitHostCmd(tc.in)
+		if err != nil || got[0] != tc.host || got[1] != tc.cmd {
+			t.Errorf("splitHostCmd(%q) = %q, %v; expected %q, %q", tc.in, got, err, tc.host, tc.cmd)
+		}
+	}
+	for _, in := range []string{"local", ":cat", "local:", "[::1"} {
+		if _, err := splitHostCmd(in); err == nil {
+			t.Errorf("splitHostCmd(%q) returned no error", in)
+		}
+	}
+}
+
+// invoke runs the command line args with stdin and returns the exit status,
+// stdout and stderr.
+func invoke(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	status := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestRun(t *testing.T) {
+	status, stdout, stderr := invoke("", "run", "local", "--", "echo", "out;", "echo", "err", ">&2")
+	if status != exitOK || stdout != "out\n" || stderr != "[cmd local] err\n" {
+		t.Errorf("got %d, %q, %q", status, stdout, stderr)
+	}
+	status, stdout, _ = invoke("hello", "-stdin", "run", "local", "--", "cat")
+	if status != exitOK || stdout != "hello" {
+		t.Errorf("with stdin got %d, %q", status, stdout)
+	}
+	if status, _, _ = invoke("", "run", "local", "--", "false"); status != exitCmd {
+		t.Errorf("failing command: expected status %d, got %d", exitCmd, status)
+	}
+	if status, _, _ = invoke("", "-timeout", "10ms", "run", "local", "--", "sleep", "5"); status != exitCmd {
+		t.Errorf("timed out command: expected status %d, got %d", exitCmd, status)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	status, stdout, _ := invoke("", "capture", "local", "--", "echo", "out;", "echo", "err", ">&2;", "exit", "3")
+	if status != exitCmd {
+		t.Errorf("expected status %d, got %d", exitCmd, status)
+	}
+	var out captureOutput
+	if err := json.Unmarshal([]byte(stdout), &out); err != nil {
+		t.Fatalf("can't decode %q: %v", stdout, err)
+	}
+	if out.Stdout != "out\n" || out.Stderr != "err\n" || out.ExitStatus != 3 || out.Error == "" {
+		t.Errorf("unexpected output %+v", out)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	status, stdout, stderr := invoke("", "pipe", "local:echo hi; echo oops >&2", "local:tr a-z A-Z")
+	if status != exitOK || stdout != "HI\n" || stderr != "[source local] oops\n" {
+		t.Errorf("got %d, %q, %q", status, stdout, stderr)
+	}
+	for _, tc := range []struct {
+		src, snk string
+		status   int
+	}{
+		{"local:echo hi; exit 1", "local:cat", exitSource},
+		{"local:echo hi", "local:cat; exit 1", exitSink},
+		{"local:yes", "local:head -1; exit 1", exitSink},
+	} {
+		if status, _, _ := invoke("", "pipe", tc.src, tc.snk); status != tc.status {
+			t.Errorf("pipe %q %q: expected status %d, got %d", tc.src, tc.snk, tc.status, status)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"frob"},
+		{"run", "local", "echo"},
+		{"pipe", "local:echo"},
+		{"pipe", "local", "local:cat"},
+		{"-nosuchflag", "run", "local", "--", "true"},
+	} {
+		if status, _, _ := invoke("", args...); status != exitUsage {
+			t.Errorf("%q: expected status %d, got %d", args, exitUsage, status)
+		}
+	}
+}
+
+func TestConnectFailure(t *testing.T) {
+	status, _, _ := invoke("", "-key", "/nonexistent", "run", "nobody@127.0.0.1:1", "--", "true")
+	if status != exitConnect {
+		t.Errorf("expected status %d, got %d", exitConnect, status)
+	}
+	status, _, _ = invoke("", "-key", "/nonexistent", "pipe", "local:echo", "nobody@127.0.0.1:1:cat")
+	if status != exitConnect {
+		t.Errorf("expected status %d, got %d", exitConnect, status)
+	}
+}
+
+// TestStreaming verifies that run passes stdin and stdout through as they
+// arrive rather than waiting for either to end.
+func TestStreaming(t *testing.T) {
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	done := make(chan int)
+	go func() {
+		done <- run([]string{"-stdin", "run", "local", "--", "echo", "ready;", "cat"}, inr, outw, ioutil.Discard)
+		outw.Close()
+	}()
+
+	out := bufio.NewReader(outr)
+	if line, err := out.ReadString('\n'); line != "ready\n" {
+		t.Fatalf("expected ready before stdin was closed, got %q, %v", line, err)
+	}
+	io.WriteString(inw, "ping\n")
+	if line, err := out.ReadString('\n'); line != "ping\n" {
+		t.Fatalf("expected ping echoed before stdin was closed, got %q, %v", line, err)
+	}
+	inw.Close()
+	go io.Copy(ioutil.Discard, out)
+	if status := <-done; status != exitOK {
+		t.Errorf("expected status %d, got %d", exitOK, status)
+	}
+}
+
+func TestHostKeyCheck(t *testing.T) {
+	addr, _ := test.SSHServer(t)
+	dir, err := ioutil.TempDir("", "piper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "id")
+	test.WriteSSHKey(t, key)
+	empty := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	target := "nobody@" + addr
+	status, _, stderr := invoke("", "-key", key, "-known-hosts", empty, "run", target, "--", "true")
+	if status != exitConnect || !strings.Contains(stderr, "no host key known") {
+		t.Errorf("unknown host key: expected status %d and a host key error, got %d, %q", exitConnect, status, stderr)
+	}
+	// Skipping the check gets as far as asking for a session.
+	status, _, stderr = invoke("", "-key", key, "-insecure-ignore-host-key", "run", target, "--", "true")
+	if status != exitConnect || strings.Contains(stderr, "host key") {
+		t.Errorf("ignored host key: expected status %d without a host key error, got %d, %q", exitConnect, status, stderr)
+	}
+}
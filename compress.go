@@ -0,0 +1,54 @@
+package piper
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+type (
+	// A Codec knows how to compress and decompress a stream, either by
+	// running filter commands on the hosts at either end of a pipe, or
+	// in-process.  Pipe normally injects Compress after the source command
+	// and Decompress before the sink command, so that only compressed data
+	// travels between the two launchers (and through our process).
+	Codec struct {
+		// Name describes the codec in errors.
+		Name string
+		// Compress is a filter command that compresses stdin to stdout.
+		Compress string
+		// Decompress is a filter command that inverts Compress.
+		Decompress string
+		// NewWriter returns a writer which compresses what it's given
+		// and writes the result to w.  Closing it must flush everything
+		// but must not close w.  May be nil if in-process compression
+		// isn't supported.
+		NewWriter func(w io.Writer) (io.WriteCloser, error)
+		// NewReader returns a reader which yields the decompressed
+		// content of r.  May be nil if in-process decompression isn't
+		// supported.
+		NewReader func(r io.Reader) (io.ReadCloser, error)
+	}
+)
+
+// Gzip compresses with gzip(1) on remote hosts and compress/gzip in-process.
+var Gzip = Codec{
+	Name:       "gzip",
+	Compress:   "gzip -c",
+	Decompress: "gzip -dc",
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+}
+
+// compressCmd returns cmd with its output compressed by c.
+func (c Codec) compressCmd(cmd string) string {
+	return shellPipeline(cmd, c.Compress)
+}
+
+// decompressCmd returns cmd with its input decompressed by c.
+func (c Codec) decompressCmd(cmd string) string {
+	return shellPipeline(c.Decompress, cmd)
+}
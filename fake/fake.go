@@ -0,0 +1,339 @@
+// Package fake provides a scriptable piper.Launcher for unit tests.  Tests
+// register handlers for the commands they expect, which are run in-process
+// in place of real commands, and can then inspect what was run.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/piper"
+)
+
+type (
+	// Handler plays the part of a command.  It reads the command's stdin
+	// and writes its stdout and stderr, returning its exit status.  ctx is
+	// cancelled if the command is killed.
+	Handler func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) int
+
+	// Behaviour describes how a command matching Pattern behaves.
+	Behaviour struct {
+		// Pattern is matched against the full command text.
+		Pattern *regexp.Regexp
+		// Handler, if non-nil, plays the command.  Otherwise the command
+		// consumes its stdin, produces no output and exits 0.
+		Handler Handler
+		// LaunchErr, StartErr, WaitErr and KillErr, if non-nil, are
+		// returned by the corresponding methods instead of their normal
+		// result.
+		LaunchErr error
+		StartErr  error
+		WaitErr   error
+		KillErr   error
+		// StartDelay and WaitDelay are slept before Start and Wait do
+		// anything.
+		StartDelay time.Duration
+		WaitDelay  time.Duration
+	}
+
+	// Launcher implements piper.Launcher by running Handlers.  Create it
+	// with NewLauncher.
+	Launcher struct {
+		*state
+		Name string
+	}
+
+	state struct {
+		mu         sync.Mutex
+		behaviours []Behaviour
+		calls      []Call
+		closed     bool
+	}
+
+	// Call records a command that was launched.
+	Call struct {
+		Command string
+		// Stdin is what the command read from its stdin.
+		Stdin string
+		// Started, Waited and Killed say which methods were called.
+		Started, Waited, Killed bool
+		// ExitStatus is what the handler returned, if it completed.
+		ExitStatus int
+	}
+
+	// ExitError is returned by Wait and Run when a handler returns a
+	// non-zero exit status.
+	ExitError struct {
+		Status int
+	}
+
+	// exe implements piper.Executor by running a Handler.
+	exe struct {
+		l       Launcher
+		cmd     string
+		b       Behaviour
+		index   int
+		ctx     context.Context
+		cancel  context.CancelFunc
+		stdinr  *io.PipeReader
+		stdinw  *io.PipeWriter
+		stdoutr *io.PipeReader
+		stdoutw *io.PipeWriter
+		stderrr *io.PipeReader
+		stderrw *io.PipeWriter
+		piped   map[string]bool
+		done    chan int
+		// started and waited are set once Start succeeds and once Wait
+		// is called, respectively.
+		started, waited bool
+	}
+
+	// stdinRecorder records what's read through it in the exe's Call.
+	stdinRecorder struct {
+		r io.Reader
+		e *exe
+	}
+)
+
+// Error implements error.
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+// ExitStatus returns the handler's exit status, for use by piper.ExitStatus.
+func (e ExitError) ExitStatus() int {
+	return e.Status
+}
+
+// NewLauncher returns a Launcher with no behaviours; name is what String
+// returns.
+func NewLauncher(name string) Launcher {
+	return Launcher{state: &state{}, Name: name}
+}
+
+// Handle adds a behaviour for commands matching pattern, which is a regexp,
+// and returns the launcher for chaining.  Behaviours are tried in the order
+// they're added.  It panics if pattern is invalid.
+func (l Launcher) Handle(pattern string, b Behaviour) Launcher {
+	b.Pattern = regexp.MustCompile(pattern)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.behaviours = append(l.behaviours, b)
+	return l
+}
+
+// HandleFunc is a shorthand for Handle with a Behaviour having only h.
+func (l Launcher) HandleFunc(pattern string, h Handler) Launcher {
+	return l.Handle(pattern, Behaviour{Handler: h})
+}
+
+// Calls returns the commands launched so far, in order.
+func (l Launcher) Calls() []Call {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Call(nil), l.calls...)
+}
+
+// Commands returns the text of the commands launched so far, in order.
+func (l Launcher) Commands() []string {
+	var cmds []string
+	for _, c := range l.Calls() {
+		cmds = append(cmds, c.Command)
+	}
+	return cmds
+}
+
+// Closed returns true if Close has been called.
+func (l Launcher) Closed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// String implements the piper.Launcher interface.
+func (l Launcher) String() string {
+	return "fake:" + l.Name
+}
+
+// Errorf implements the piper.Launcher interface.
+func (l Launcher) Errorf(pat string, args ...interface{}) error {
+	return fmt.Errorf("%s: %w", l, fmt.Errorf(pat, args...))
+}
+
+// Close implements the piper.Launcher interface.
+func (l Launcher) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	return nil
+}
+
+// update applies f to the Call for e.
+func (e *exe) update(f func(c *Call)) {
+	e.l.mu.Lock()
+	defer e.l.mu.Unlock()
+	f(&e.l.calls[e.index])
+}
+
+// Launch implements the piper.Launcher interface using the first behaviour
+// whose pattern matches cmd.  Commands matching no pattern fail to launch.
+// Every Launch is recorded as a Call, even if it fails.
+func (l Launcher) Launch(cmd string) (piper.Executor, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, Call{Command: cmd})
+	for _, b := range l.behaviours {
+		if !b.Pattern.MatchString(cmd) {
+			continue
+		}
+		if b.LaunchErr != nil {
+			return nil, b.LaunchErr
+		}
+		e := &exe{l: l, cmd: cmd, b: b, index: len(l.calls) - 1, piped: make(map[string]bool), done: make(chan int, 1)}
+		e.ctx, e.cancel = context.WithCancel(context.Background())
+		e.stdinr, e.stdinw = io.Pipe()
+		e.stdoutr, e.stdoutw = io.Pipe()
+		e.stderrr, e.stderrw = io.Pipe()
+		return e, nil
+	}
+	return nil, fmt.Errorf("no fake behaviour for command %q", cmd)
+}
+
+// Command implements the piper.Executor interface.
+func (e *exe) Command() string {
+	return e.cmd
+}
+
+// Errorf implements the piper.Executor interface.
+func (e *exe) Errorf(pat string, args ...interface{}) error {
+	pfx := fmt.Sprintf("cmd %s{%s} :", e.l, e.cmd)
+	return fmt.Errorf("%s: %w", pfx, fmt.Errorf(pat, args...))
+}
+
+// StdinPipe implements the piper.Executor interface.
+func (e *exe) StdinPipe() (io.WriteCloser, error) {
+	e.piped["stdin"] = true
+	return e.stdinw, nil
+}
+
+// StdoutPipe implements the piper.Executor interface.
+func (e *exe) StdoutPipe() (io.ReadCloser, error) {
+	e.piped["stdout"] = true
+	return e.stdoutr, nil
+}
+
+// StderrPipe implements the piper.Executor interface.
+func (e *exe) StderrPipe() (io.ReadCloser, error) {
+	e.piped["stderr"] = true
+	return e.stderrr, nil
+}
+
+func (sr stdinRecorder) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.e.update(func(c *Call) { c.Stdin += string(p[:n]) })
+	return n, err
+}
+
+// Start implements the piper.Executor interface by running the handler in a
+// goroutine.  Streams that weren't piped behave like /dev/null.
+func (e *exe) Start() error {
+	time.Sleep(e.b.StartDelay)
+	if e.b.StartErr != nil {
+		return e.b.StartErr
+	}
+	e.update(func(c *Call) { c.Started = true })
+	e.started = true
+
+	var stdin io.Reader = eofReader{}
+	if e.piped["stdin"] {
+		stdin = stdinRecorder{e.stdinr, e}
+	}
+	var stdout, stderr io.Writer = ioutil.Discard, ioutil.Discard
+	if e.piped["stdout"] {
+		stdout = e.stdoutw
+	}
+	if e.piped["stderr"] {
+		stderr = e.stderrw
+	}
+
+	go func() {
+		status := 0
+		if e.b.Handler != nil {
+			status = e.b.Handler(e.ctx, stdin, stdout, stderr)
+		} else {
+			io.Copy(ioutil.Discard, stdin)
+		}
+		// Like a real process exiting, stop reading stdin and close
+		// the output pipes.
+		e.stdinr.Close()
+		e.stdoutw.Close()
+		e.stderrw.Close()
+		e.done <- status
+	}()
+	return nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Wait implements the piper.Executor interface by waiting for the handler to
+// return.  Like exec.Cmd, it fails without blocking if the command wasn't
+// started or Wait was already called; in the former case it closes the
+// pipes so nothing is left waiting on them.
+func (e *exe) Wait() error {
+	if !e.started {
+		e.cancel()
+		e.stdinr.Close()
+		e.stdoutw.Close()
+		e.stderrw.Close()
+		return e.Errorf("not started")
+	}
+	if e.waited {
+		return e.Errorf("Wait was already called")
+	}
+	e.waited = true
+	time.Sleep(e.b.WaitDelay)
+	status := <-e.done
+	e.update(func(c *Call) { c.Waited, c.ExitStatus = true, status })
+	if e.b.WaitErr != nil {
+		return e.b.WaitErr
+	}
+	if e.ctx.Err() != nil {
+		return fmt.Errorf("killed")
+	}
+	if status != 0 {
+		return ExitError{status}
+	}
+	return nil
+}
+
+// Run implements the piper.Executor interface.
+func (e *exe) Run() error {
+	if err := e.Start(); err != nil {
+		return err
+	}
+	return e.Wait()
+}
+
+// Kill implements the piper.Executor interface by cancelling the handler's
+// context and closing its pipes.  Handlers that heed neither will keep
+// running.
+func (e *exe) Kill() error {
+	e.update(func(c *Call) { c.Killed = true })
+	if e.b.KillErr != nil {
+		return e.b.KillErr
+	}
+	e.cancel()
+	e.stdinr.Close()
+	e.stdoutw.Close()
+	e.stderrw.Close()
+	return nil
+}
@@ -0,0 +1,140 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/piper"
+)
+
+// Verify implementation of Executor and Launcher interfaces.
+func TestInterfaces(t *testing.T) {
+	_ = piper.Launcher(Launcher{})
+	_ = piper.Executor(&exe{})
+}
+
+func cat(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) int {
+	io.Copy(stdout, stdin)
+	return 0
+}
+
+func TestFakeRunCmd(t *testing.T) {
+	l := NewLauncher("host").
+		HandleFunc("^echo ", func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) int {
+			fmt.Fprint(stdout, "out")
+			fmt.Fprint(stderr, "err")
+			return 0
+		}).
+		HandleFunc("^fail$", func(context.Context, io.Reader, io.Writer, io.Writer) int { return 4 }).
+		HandleFunc("^cat$", cat)
+
+	stdout, stderr, err := piper.RunCmdCapture(l, "echo x")
+	if stdout != "out" || stderr != "err" || err != nil {
+		t.Errorf("expected out, err, nil; got %q, %q, %v", stdout, stderr, err)
+	}
+	if err := piper.RunCmd(l, "fail"); piper.ExitStatus(err) != 4 {
+		t.Errorf("expected exit status 4, got %v", err)
+	}
+	if err := piper.RunCmd(l, "unknown"); !piper.IsStartError(err) {
+		t.Errorf("expected StartError for unknown command, got %v", err)
+	}
+	if stdout, _, err := piper.RunCmdStrInCapture(l, "cat", "hello"); stdout != "hello" || err != nil {
+		t.Errorf("expected hello, got %q, %v", stdout, err)
+	}
+
+	want := []Call{
+		{Command: "echo x", Started: true, Waited: true},
+		{Command: "fail", Started: true, Waited: true, ExitStatus: 4},
+		{Command: "unknown"},
+		{Command: "cat", Stdin: "hello", Started: true, Waited: true},
+	}
+	if got := l.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected calls %+v, got %+v", want, got)
+	}
+}
+
+func TestFakePipe(t *testing.T) {
+	src := NewLauncher("src").HandleFunc("^produce$", func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) int {
+		fmt.Fprint(stdout, "payload")
+		return 0
+	})
+	snk := NewLauncher("snk").HandleFunc("^consume$", cat)
+	pr := piper.Pipe(piper.Launchable{Launcher: src, Cmd: "produce"}, piper.Launchable{Launcher: snk, Cmd: "consume"})
+	if pr.Err != nil || pr.SnkStdout != "payload" {
+		t.Errorf("expected payload, got %+v", pr)
+	}
+	if calls := snk.Calls(); len(calls) != 1 || calls[0].Stdin != "payload" {
+		t.Errorf("sink didn't receive payload: %+v", calls)
+	}
+}
+
+func TestFakeFailures(t *testing.T) {
+	boom := errors.New("boom")
+	l := NewLauncher("host").
+		Handle("^launch$", Behaviour{LaunchErr: boom}).
+		Handle("^start$", Behaviour{StartErr: boom}).
+		Handle("^wait$", Behaviour{WaitErr: boom, WaitDelay: 10 * time.Millisecond})
+
+	for _, cmd := range []string{"launch", "start", "wait"} {
+		if err := piper.RunCmd(l, cmd); !errors.Is(err, boom) {
+			t.Errorf("%s: expected boom, got %v", cmd, err)
+		}
+	}
+	if err := piper.RunCmd(l, "start"); !piper.IsStartError(err) {
+		t.Errorf("expected StartError, got %v", err)
+	}
+}
+
+func TestFakeKill(t *testing.T) {
+	l := NewLauncher("host").HandleFunc("^hang$", func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) int {
+		<-ctx.Done()
+		return 1
+	})
+	rr := piper.RunCmdWith(l, "hang", piper.RunOptions{Capture: true, Timeout: 10 * time.Millisecond})
+	if rr.Err == nil {
+		t.Errorf("expected hang to be killed")
+	}
+	if calls := l.Calls(); !calls[0].Killed {
+		t.Errorf("expected kill to be recorded: %+v", calls)
+	}
+}
+
+func TestFakeWaitMisuse(t *testing.T) {
+	l := NewLauncher("host").
+		HandleFunc("^cat$", cat).
+		Handle("^start$", Behaviour{StartErr: errors.New("boom")})
+
+	for _, cmd := range []string{"cat", "start"} {
+		exe, err := l.Launch(cmd)
+		if err != nil {
+			t.Fatalf("error launching %s: %v", cmd, err)
+		}
+		exe.Start()
+		if err := exe.Wait(); cmd == "start" && err == nil {
+			t.Errorf("%s: expected error waiting after Start failed", cmd)
+		}
+		if err := exe.Wait(); err == nil {
+			t.Errorf("%s: expected error from second Wait", cmd)
+		}
+	}
+
+	exe, err := l.Launch("cat")
+	if err != nil {
+		t.Fatalf("error launching cat: %v", err)
+	}
+	stdout, err := exe.StdoutPipe()
+	if err != nil {
+		t.Fatalf("error opening stdout pipe: %v", err)
+	}
+	if err := exe.Wait(); err == nil {
+		t.Errorf("expected error waiting without Start")
+	}
+	if _, err := stdout.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF from stdout of unstarted command, got %v", err)
+	}
+}
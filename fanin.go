@@ -0,0 +1,167 @@
+package piper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// FanInMode says how FanIn combines its sources.
+type FanInMode int
+
+const (
+	// Concatenate runs the sources one after another, so that the sink
+	// sees all of the first's output, then all of the second's, etc.
+	Concatenate FanInMode = iota
+	// Interleave runs the sources concurrently, passing on whole lines
+	// from each as they arrive.
+	Interleave
+)
+
+type (
+	// FanInOptions modifies how FanIn combines its sources.
+	FanInOptions struct {
+		Mode FanInMode
+		// Prefix, if non-nil, gives a string to prepend to each line
+		// from src, e.g. its launcher's description.
+		Prefix func(src Launchable) string
+		// CaptureLimit is as for PipeOptions.
+		CaptureLimit int
+	}
+
+	// FanInResult summarizes the result of FanIn.
+	FanInResult struct {
+		// Sources has an entry for each source, in the order given.
+		Sources   []SourceResult
+		SnkStderr string
+		SnkStdout string
+		// Err describes the first failure, of the sink or any source.
+		Err error
+	}
+
+	// SourceResult is the outcome of one of FanIn's sources.
+	SourceResult struct {
+		Stderr string
+		Err    error
+	}
+)
+
+// FanIn invokes several source commands and the sink command, feeding the
+// stdout of all the sources into the stdin of the sink.
+func FanIn(srclchs []Launchable, snklch Launchable, opts FanInOptions) FanInResult {
+	snkexe, err := snklch.LaunchCmd()
+	if err != nil {
+		return FanInResult{Err: &StartError{snklch.Errorf("error creating fan-in sink: %w", err)}}
+	}
+	snkstdout, snkstderr := newCapture(opts.CaptureLimit), newCapture(opts.CaptureLimit)
+	snk, err := recv(snkexe, snkstdout, snkstderr, snkstdout, snkstderr, nil)
+	if err != nil {
+		release(snkexe)
+		return FanInResult{Err: &StartError{err}}
+	}
+
+	fr := FanInResult{Sources: make([]SourceResult, len(srclchs))}
+	var mu sync.Mutex
+	feed := func(i int) {
+		fr.Sources[i] = fanInSource(srclchs[i], snk.stdin, &mu, opts)
+	}
+	if opts.Mode == Interleave {
+		var wg sync.WaitGroup
+		for i := range srclchs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				feed(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range srclchs {
+			feed(i)
+		}
+	}
+
+	snk.stdin.Close()
+	snkerr := joinerrs("; ", <-snk.errchan, <-snk.errchan)
+	if err := snk.exe.Wait(); err != nil {
+		snkerr = joinerrs("; ", snkerr, fmt.Errorf("sink exited with error: %w", err))
+	}
+	fr.SnkStdout, fr.SnkStderr = snk.stdout.String(), snk.stderr.String()
+
+	var errs []error
+	for i, sr := range fr.Sources {
+		if sr.Err != nil {
+			errs = append(errs, fmt.Errorf("source %d: %w", i, sr.Err))
+		}
+	}
+	fr.Err = joinerrs("; ", append([]error{snkerr}, errs...)...)
+	return fr
+}
+
+// fanInSource runs src, writing its stdout to w.  Writes are done holding mu,
+// a line at a time if need be, so that sources running concurrently don't
+// garble each other's lines.
+func fanInSource(srclch Launchable, w io.Writer, mu *sync.Mutex, opts FanInOptions) SourceResult {
+	exe, err := srclch.LaunchCmd()
+	if err != nil {
+		return SourceResult{Err: &StartError{srclch.Errorf("error creating fan-in source: %w", err)}}
+	}
+	stderr := newCapture(opts.CaptureLimit)
+	src, err := send(exe, stderr, stderr, nil)
+	if err != nil {
+		release(exe)
+		return SourceResult{Err: &StartError{err}}
+	}
+
+	prefix := ""
+	if opts.Prefix != nil {
+		prefix = opts.Prefix(srclch)
+	}
+	var copyerr error
+	if opts.Mode == Concatenate && prefix == "" {
+		_, copyerr = io.Copy(w, src.stdout)
+	} else {
+		copyerr = copyLines(w, src.stdout, prefix, mu)
+	}
+	if copyerr != nil {
+		// The sink has gone away, so there's no point carrying on.
+		src.exe.Kill()
+		io.Copy(ioutil.Discard, src.stdout)
+		copyerr = fmt.Errorf("error piping: %w", copyerr)
+	}
+
+	err = joinerrs("; ", copyerr, <-src.errchan)
+	if werr := src.exe.Wait(); werr != nil {
+		err = joinerrs("; ", err, fmt.Errorf("source exited with error: %w", werr))
+	}
+	return SourceResult{Stderr: stderr.String(), Err: err}
+}
+
+// copyLines copies r to w a line at a time, prefixing each, while holding mu.
+// A final unterminated line is given a newline so the next writer's output
+// starts on a line of its own.
+func copyLines(w io.Writer, r io.Reader, prefix string, mu *sync.Mutex) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			mu.Lock()
+			_, werr := io.WriteString(w, prefix+string(line))
+			mu.Unlock()
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package piper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// maxJSONStderr bounds how much stderr we keep from commands whose output
+// we decode, for use in error messages.
+const maxJSONStderr = 4 << 10
+
+// JSONScanner decodes a stream of JSON values, one per record, from a
+// running command's stdout, e.g. NDJSON.  Blank records are skipped.
+type JSONScanner struct {
+	lch Launcher
+	cmd string
+	s   *Scanner
+	// rec counts the records read.
+	rec int
+	err error
+}
+
+// jsonErrorf returns an error as fmt.Errorf would, prepending a description
+// of cmd and lch and appending stderr, the command's stderr.
+func jsonErrorf(lch Launcher, cmd, stderr string, pat string, args ...interface{}) error {
+	pfx := fmt.Sprintf("cmd %s{%s} :", lch, cmd)
+	return withStderr(fmt.Errorf("%s: %w", pfx, fmt.Errorf(pat, args...)), stderr)
+}
+
+// withStderr returns err with stderr appended, if there was any.
+func withStderr(err error, stderr string) error {
+	if s := strings.TrimSpace(stderr); s != "" {
+		return fmt.Errorf("%w; stderr: %s", err, s)
+	}
+	return err
+}
+
+// RunCmdJSON executes cmd using lch and decodes its stdout, which must be
+// a single JSON value, into v as json.Unmarshal would.  If the command
+// fails or its output can't be decoded, the error includes its stderr.
+func RunCmdJSON(lch Launcher, cmd string, v interface{}) error {
+	h, err := startCmd(lch, cmd)
+	if err != nil {
+		return err
+	}
+	stderr := newCapture(maxJSONStderr)
+	r, w := io.Pipe()
+	h.stdout, h.stderr = w, stderr
+	decerr := make(chan error, 1)
+	go func() {
+		decerr <- decodeOne(r, v)
+		// Drain the rest so the command isn't blocked writing it.
+		io.Copy(ioutil.Discard, r)
+	}()
+	err = h.run()
+	w.Close()
+	if derr := <-decerr; err == nil && derr != nil {
+		return jsonErrorf(lch, cmd, stderr.String(), "error decoding output as JSON: %w", derr)
+	}
+	if err != nil {
+		return withStderr(err, stderr.String())
+	}
+	return nil
+}
+
+// decodeOne decodes the only JSON value r yields into v.
+func decodeOne(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(v); err == io.EOF {
+		return errors.New("no output")
+	} else if err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// ScanCmdJSON starts cmd using lch and returns a JSONScanner over its
+// stdout, split into records as by ScanCmd.  An error is returned only if
+// the command couldn't be started.
+func ScanCmdJSON(lch Launcher, cmd string, opts ScanOptions) (*JSONScanner, error) {
+	if opts.CaptureLimit <= 0 {
+		opts.CaptureLimit = maxJSONStderr
+	}
+	s, err := ScanCmd(lch, cmd, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONScanner{lch: lch, cmd: cmd, s: s}, nil
+}
+
+// Decode decodes the next value into v as json.Unmarshal would.  Once the
+// values are exhausted it returns io.EOF if the command succeeded, or an
+// error including its stderr if not.  If a value can't be decoded, the
+// command is killed and an error returned saying which record it was; all
+// later calls return the same error.
+func (j *JSONScanner) Decode(v interface{}) error {
+	if j.err != nil {
+		return j.err
+	}
+	for j.s.Next() {
+		j.rec++
+		if len(bytes.TrimSpace(j.s.Bytes())) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(j.s.Bytes(), v); err != nil {
+			j.s.Close()
+			j.err = jsonErrorf(j.lch, j.cmd, j.s.Stderr(), "error decoding record %d as JSON: %w", j.rec, err)
+			return j.err
+		}
+		return nil
+	}
+	if err := j.s.Err(); err != nil {
+		j.err = withStderr(err, j.s.Stderr())
+	} else {
+		j.err = io.EOF
+	}
+	return j.err
+}
+
+// Close releases the command as Scanner.Close does.  It returns the error
+// Decode returned, if any other than io.EOF.
+func (j *JSONScanner) Close() error {
+	err := j.s.Close()
+	if j.err != nil && j.err != io.EOF {
+		return j.err
+	}
+	return err
+}
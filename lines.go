@@ -0,0 +1,96 @@
+package piper
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxLineLen bounds the length of a line passed to a StderrFunc; longer lines
+// are passed on in pieces.
+const maxLineLen = 64 << 10
+
+// Stages identify which command produced a StderrLine.  StageFilter is for
+// the stages of a Pipeline between its source and sink.
+const (
+	StageSource = "source"
+	StageSink   = "sink"
+	StageFilter = "filter"
+	StageCmd    = "cmd"
+)
+
+type (
+	// StderrLine is a line of stderr output, without its newline, as
+	// passed to a StderrFunc.
+	StderrLine struct {
+		// Stage is one of the Stage constants.
+		Stage string
+		// Launcher is the String() of the launcher running the command.
+		Launcher string
+		// Time is when the line was completed.
+		Time time.Time
+		Text string
+	}
+
+	// lineFunc serializes calls to a StderrFunc made from multiple streams.
+	lineFunc struct {
+		mu sync.Mutex
+		fn func(StderrLine)
+	}
+
+	// lineWriter writes to w, also passing each line written to lf.
+	lineWriter struct {
+		w        io.Writer
+		lf       *lineFunc
+		stage    string
+		launcher string
+		partial  []byte
+	}
+)
+
+func newLineFunc(fn func(StderrLine)) *lineFunc {
+	return &lineFunc{fn: fn}
+}
+
+// writer returns a writer that writes to w, and if lf has a function, passes
+// it each line written tagged with stage and lch.
+func (lf *lineFunc) writer(w io.Writer, stage string, lch Launcher) io.Writer {
+	if lf.fn == nil {
+		return w
+	}
+	return &lineWriter{w: w, lf: lf, stage: stage, launcher: lch.String()}
+}
+
+// Write implements io.Writer.
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	n, err := lw.w.Write(p)
+	lw.partial = append(lw.partial, p[:n]...)
+	for {
+		i := bytes.IndexByte(lw.partial, '\n')
+		if i < 0 {
+			break
+		}
+		lw.emit(lw.partial[:i])
+		lw.partial = lw.partial[i+1:]
+	}
+	if len(lw.partial) >= maxLineLen {
+		lw.Flush()
+	}
+	return n, err
+}
+
+// Flush passes on any final unterminated line.
+func (lw *lineWriter) Flush() error {
+	if len(lw.partial) > 0 {
+		lw.emit(lw.partial)
+		lw.partial = nil
+	}
+	return nil
+}
+
+func (lw *lineWriter) emit(line []byte) {
+	lw.lf.mu.Lock()
+	defer lw.lf.mu.Unlock()
+	lw.lf.fn(StderrLine{Stage: lw.stage, Launcher: lw.launcher, Time: time.Now(), Text: string(line)})
+}
@@ -3,36 +3,112 @@ package local
 import (
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"sync"
+	"syscall"
 
 	"github.com/ncabatoff/piper"
 )
 
 type (
-	// Launcher implements piper.Launcher by spawning a local process
-	Launcher struct{}
+	// Launcher implements piper.Launcher by spawning a local process.  The
+	// zero value runs commands as we are; the fields below, which are only
+	// supported on Linux, change that.
+	//
+	// Outside Windows, each command runs in a process group of its own so
+	// that Kill reaches everything it spawned.  As a result, signals sent to
+	// our process group, such as SIGINT from Ctrl-C or SIGHUP when our
+	// terminal goes away, don't reach commands.  On Linux the commands' shells
+	// are instead killed when we exit, as described for Pdeathsig; anything
+	// they've spawned is left to run.
+	Launcher struct {
+		// Credential, if non-nil, gives the user and groups to run
+		// commands as.  We must be privileged to use it.
+		Credential *Credential
+		// Rlimits are applied to each command before it runs.
+		Rlimits []Rlimit
+		// Nice, if non-zero, is the niceness to run commands at.
+		Nice int
+		// IOClass, unless IOClassNone, is the I/O scheduling class to run
+		// commands in, with IOPriority (0-7, lower is more urgent) being
+		// their priority within it.
+		IOClass    IOClass
+		IOPriority int
+		// Pdeathsig is sent to each command's shell if the thread that
+		// started it exits, as for prctl(PR_SET_PDEATHSIG).  Go threads
+		// normally live as long as the process, so in practice this means
+		// when we exit.  On Linux the default is SIGKILL, since commands
+		// are otherwise out of reach of signals meant to stop us.
+		Pdeathsig syscall.Signal
+		// Sandbox, if non-nil, runs commands in a sandbox.  It can't be
+		// combined with Credential.
+		Sandbox *Sandbox
+	}
 
 	// exe implements piper.Executor by wrapping os/exec.Cmd
 	exe struct {
 		*exec.Cmd
 		cancel  context.CancelFunc
 		command string
+		// mu serializes Start and Kill, so that a Kill during Start
+		// waits for the process to exist and then kills it.  It also
+		// guards reaped.
+		mu *sync.Mutex
+		// reaped is set once the process has exited and is about to be
+		// reaped, after which its pid, and so its process group ID, may
+		// be reused; Kill must then leave the group alone.
+		reaped *bool
+		// gate, if non-nil, holds the command back until options have
+		// been applied to it.
+		gate *gate
+	}
+
+	// gate holds a command back until apply has been called on its pid.
+	// The command's shell waits to read a line from r (as fd 3) before
+	// running the command proper, and we write that line to w.
+	gate struct {
+		r, w  *os.File
+		apply func(pid int) error
 	}
 )
 
+// gateScript is prepended to commands held back by a gate.  If the gate
+// is closed without our writing to it, the shell exits rather than running
+// the command unrestricted.
+const gateScript = "read _ <&3 || exit 125; exec 3<&-\n"
+
 func (l Launcher) String() string {
 	return "local"
 }
 
 // Errorf implements the piper.Launcher interface.
 func (l Launcher) Errorf(pat string, args ...interface{}) error {
-	return fmt.Errorf(pat, args)
+	return fmt.Errorf(pat, args...)
 }
 
 // Launch implements the piper.Launcher interface by invoking sh.
 func (l Launcher) Launch(cmd string) (piper.Executor, error) {
 	ctx, cancel := context.WithCancel(context.Background())
-	return exe{exec.CommandContext(ctx, "sh", "-c", cmd), cancel, cmd}, nil
+	c := exec.CommandContext(ctx, "sh", "-c", cmd)
+	setpgid(c)
+	apply, err := l.configure(c)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if apply == nil {
+		return exe{Cmd: c, cancel: cancel, command: cmd, mu: &sync.Mutex{}, reaped: new(bool)}, nil
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c.Args[2] = gateScript + c.Args[2]
+	c.ExtraFiles = []*os.File{r}
+	return exe{Cmd: c, cancel: cancel, command: cmd, mu: &sync.Mutex{}, reaped: new(bool), gate: &gate{r: r, w: w, apply: apply}}, nil
 }
 
 // Close implements the piper.Launcher interface.
@@ -43,7 +119,7 @@ func (l Launcher) Close() error {
 // Errorf implements the piper.Executor interface.
 func (e exe) Errorf(pat string, args ...interface{}) error {
 	pfx := fmt.Sprintf("cmd {%s} :", e.command)
-	return fmt.Errorf("%s: %v", pfx, fmt.Errorf(pat, args...))
+	return fmt.Errorf("%s: %w", pfx, fmt.Errorf(pat, args...))
 }
 
 // Command implements the piper.Launcher interface.
@@ -51,8 +127,95 @@ func (e exe) Command() string {
 	return e.command
 }
 
-// Kill implements the piper.Launcher interface.
+// Start implements the piper.Executor interface.  If the command is held
+// back by a gate, it's let through once options have been applied.
+func (e exe) Start() error {
+	e.mu.Lock()
+	err := e.Cmd.Start()
+	e.mu.Unlock()
+	if e.gate == nil {
+		return err
+	}
+	e.gate.r.Close()
+	if err != nil {
+		e.gate.w.Close()
+		return err
+	}
+	if err := e.gate.apply(e.Process.Pid); err != nil {
+		// Kill before closing the gate, so the command never runs.
+		e.Kill()
+		e.gate.w.Close()
+		e.reap()
+		return err
+	}
+	if _, err := e.gate.w.Write([]byte("\n")); err != nil {
+		e.Kill()
+		e.gate.w.Close()
+		e.reap()
+		return err
+	}
+	return e.gate.w.Close()
+}
+
+// Wait implements the piper.Executor interface.  Waiting on a command that
+// was never started releases what Launch acquired for it.
+func (e exe) Wait() error {
+	defer e.cancel()
+	if e.Process == nil {
+		if e.gate != nil {
+			e.gate.r.Close()
+			e.gate.w.Close()
+		}
+		return e.Cmd.Wait()
+	}
+	return e.reap()
+}
+
+// reap waits for the started command to exit and reaps it.  Until then its
+// pid can't be reused, so Kill may signal its process group; where we can
+// wait for it to exit without reaping it, Kill is stopped before it is.
+func (e exe) reap() error {
+	if waitExited(e.Process.Pid) {
+		e.setReaped()
+	}
+	err := e.Cmd.Wait()
+	e.setReaped()
+	return err
+}
+
+// setReaped records that Kill must no longer signal the process group.
+func (e exe) setReaped() {
+	e.mu.Lock()
+	*e.reaped = true
+	e.mu.Unlock()
+}
+
+// Run implements the piper.Executor interface.
+func (e exe) Run() error {
+	if err := e.Start(); err != nil {
+		return err
+	}
+	return e.Wait()
+}
+
+// Kill implements the piper.Launcher interface.  It kills sh and anything
+// it spawned, unless sh has already exited and been waited for.
 func (e exe) Kill() error {
 	e.cancel()
-	return nil
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if *e.reaped {
+		return nil
+	}
+	return killgroup(e.Cmd)
+}
+
+// SetStdin implements the piper.FileExecutor interface.
+func (e exe) SetStdin(f *os.File) {
+	e.Stdin = f
+}
+
+// SetStdout implements the piper.FileExecutor interface.
+func (e exe) SetStdout(f *os.File) {
+	e.Stdout = f
 }
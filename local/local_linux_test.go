@@ -0,0 +1,214 @@
+package local
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/piper"
+	"github.com/ncabatoff/piper/test"
+)
+
+func TestLocalRlimits(t *testing.T) {
+	l := Launcher{Rlimits: []Rlimit{
+		{Resource: RlimitNofile, Cur: 64, Max: 64},
+		{Resource: RlimitFsize, Cur: 1024, Max: RlimitInfinity},
+	}}
+	stdout, _, err := piper.RunCmdCapture(l, "ulimit -n; ulimit -f")
+	if err != nil {
+		t.Fatalf("error running: %v", err)
+	}
+	// ulimit -f reports 512-byte blocks.
+	if want := "64\n2\n"; stdout != want {
+		t.Errorf("expected %q, got %q", want, stdout)
+	}
+	if err := piper.RunCmd(l, "head -c 2048 /dev/zero > /dev/null"); err != nil {
+		t.Errorf("error writing to /dev/null: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "rlimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := dir + "/ran"
+	l.Rlimits = []Rlimit{{Resource: RlimitNofile, Cur: 64, Max: 32}}
+	if err := piper.RunCmd(l, "touch "+marker); !piper.IsStartError(err) {
+		t.Errorf("expected start error for invalid rlimit, got %v", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("command ran despite its rlimits failing to apply")
+	}
+	// Nor does it run if the gate is closed without being opened.
+	devnull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	gated := exec.Command("sh", "-c", gateScript+"touch "+marker)
+	gated.ExtraFiles = []*os.File{devnull}
+	if err := gated.Run(); piper.ExitStatus(err) != 125 {
+		t.Errorf("expected exit status 125 from closed gate, got %v", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("command ran despite its gate being closed")
+	}
+	l.Rlimits = []Rlimit{{Resource: 99}}
+	if err := piper.RunCmd(l, "true"); err == nil {
+		t.Errorf("expected error for unknown resource")
+	}
+}
+
+func TestLocalNice(t *testing.T) {
+	l := Launcher{Nice: 7, IOClass: IOClassBestEffort, IOPriority: 6}
+	stdout, _, err := piper.RunCmdCapture(l, "nice; ionice")
+	if err != nil {
+		t.Fatalf("error running: %v", err)
+	}
+	if want := "7\nbest-effort: prio 6\n"; stdout != want {
+		t.Errorf("expected %q, got %q", want, stdout)
+	}
+	l = Launcher{IOClass: IOClassIdle}
+	if stdout, _, err = piper.RunCmdCapture(l, "ionice"); err != nil || stdout != "idle\n" {
+		t.Errorf("expected idle, got %q, %v", stdout, err)
+	}
+	l = Launcher{IOPriority: 8, IOClass: IOClassBestEffort}
+	if err := piper.RunCmd(l, "true"); err == nil {
+		t.Errorf("expected error for invalid I/O priority")
+	}
+}
+
+func TestLocalCredential(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing user needs root")
+	}
+	l := Launcher{Credential: &Credential{Uid: 65534, Gid: 65534, Groups: []uint32{65533}}, Pdeathsig: syscall.SIGKILL}
+	stdout, _, err := piper.RunCmdCapture(l, "id -u; id -g; id -G")
+	if err != nil {
+		t.Fatalf("error running: %v", err)
+	}
+	if f := strings.Fields(stdout); len(f) < 3 || f[0] != "65534" || f[1] != "65534" || !strings.Contains(stdout, "65533") {
+		t.Errorf("expected uid, gid 65534 with group 65533, got %q", stdout)
+	}
+}
+
+// TestLocalKillAfterWait verifies that Kill leaves a command's process group
+// alone once the command has been waited for, since by then the group's ID
+// may belong to someone else.  A background child stands in for them.
+func TestLocalKillAfterWait(t *testing.T) {
+	exe, err := Launcher{}.Launch("sleep 30 >/dev/null 2>&1 & echo $!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := exe.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exe.Start(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exe.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		t.Fatalf("expected a pid, got %q", out)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+
+	if err := exe.Kill(); err != nil {
+		t.Errorf("error killing after Wait: %v", err)
+	}
+	// A killed process may linger as a zombie, so check its state.
+	for i := 0; i < 10; i++ {
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if f := strings.Fields(string(stat)); err != nil || len(f) < 3 || f[2] == "Z" {
+			t.Fatalf("Kill after Wait signalled the process group")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLocalOptionsPipe(t *testing.T) {
+	l := Launcher{Nice: 3}
+	pr := piper.Pipe(piper.Launchable{Launcher: l, Cmd: "nice"}, piper.Launchable{Launcher: l, Cmd: "cat; nice"})
+	if pr.Err != nil || pr.SnkStdout != "3\n3\n" {
+		t.Errorf("expected niceness 3 on both sides, got %q, %v", pr.SnkStdout, pr.Err)
+	}
+}
+
+// Commands held back until their options are applied should behave like
+// any others.
+func TestLocalConformanceOptions(t *testing.T) {
+	test.ConformanceTest(t, func(*testing.T) piper.Launcher { return Launcher{Nice: 1} })
+}
+
+// sandboxed returns a Launcher using sb, skipping the test if namespaces
+// aren't available to us.
+func sandboxed(t *testing.T, sb *Sandbox) Launcher {
+	l := Launcher{Sandbox: sb}
+	if _, stderr, err := piper.RunCmdCapture(l, "true"); err != nil {
+		t.Skipf("can't create sandbox: %v: %s", err, stderr)
+	}
+	return l
+}
+
+func TestLocalSandbox(t *testing.T) {
+	dir, rw := t.TempDir(), t.TempDir()
+	l := sandboxed(t, &Sandbox{Writable: []string{rw}})
+
+	if err := piper.RunCmd(l, "echo x > "+piper.ShellQuote(dir+"/f")); err == nil {
+		t.Errorf("expected error writing outside sandbox")
+	}
+	if err := piper.RunCmd(l, "echo x > "+piper.ShellQuote(rw+"/f")); err != nil {
+		t.Errorf("error writing to writable dir: %v", err)
+	} else if b, err := ioutil.ReadFile(rw + "/f"); err != nil || string(b) != "x\n" {
+		t.Errorf("expected x written to writable dir, got %q, %v", b, err)
+	}
+
+	// We should be pid 1, see only our own processes, and have no network
+	// interfaces but loopback.
+	stdout, _, err := piper.RunCmdCapture(l, fmt.Sprintf("echo $$; test -e /proc/%d && echo visible; grep -c : /proc/net/dev", os.Getpid()))
+	if err != nil {
+		t.Fatalf("error running: %v", err)
+	}
+	if want := "1\n1\n"; stdout != want {
+		t.Errorf("expected pid 1, test process not visible, 1 interface, got %q", stdout)
+	}
+}
+
+func TestLocalSandboxNetwork(t *testing.T) {
+	stdout, _, err := piper.RunCmdCapture(Launcher{}, "grep -c : /proc/net/dev")
+	if err != nil {
+		t.Fatalf("error running: %v", err)
+	}
+	l := sandboxed(t, &Sandbox{Network: true})
+	if sbout, _, err := piper.RunCmdCapture(l, "grep -c : /proc/net/dev"); err != nil || sbout != stdout {
+		t.Errorf("expected host's interface count %q, got %q, %v", stdout, sbout, err)
+	}
+}
+
+func TestLocalSandboxPipeline(t *testing.T) {
+	l := sandboxed(t, &Sandbox{})
+	pr := piper.Pipeline([]piper.Launchable{
+		{Launcher: Launcher{}, Cmd: "printf 'a\\nb\\n'"},
+		{Launcher: l, Cmd: "tr a-z A-Z"},
+		{Launcher: Launcher{}, Cmd: "cat"},
+	}, piper.PipelineOptions{})
+	if pr.Err != nil || pr.Stdout != "A\nB\n" {
+		t.Errorf("expected A B, got %q, %v", pr.Stdout, pr.Err)
+	}
+	if _, err := (Launcher{Sandbox: &Sandbox{}, Credential: &Credential{}}).Launch("true"); err == nil {
+		t.Errorf("expected error combining Sandbox and Credential")
+	}
+}
@@ -1,8 +1,12 @@
 package local
 
 import (
+	"crypto/md5"
 	"github.com/ncabatoff/piper"
 	"github.com/ncabatoff/piper/test"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -27,3 +31,137 @@ func TestLocalCapture(t *testing.T) {
 func TestLocalPipe(t *testing.T) {
 	test.PipeTest(t, Launcher{}, Launcher{})
 }
+
+func TestLocalPipeCodec(t *testing.T) {
+	test.PipeCodecTest(t, Launcher{}, Launcher{}, piper.Gzip)
+}
+
+func TestLocalPipeDirect(t *testing.T) {
+	test.PipeDirectTest(t, Launcher{}, Launcher{}, false)
+}
+
+func TestLocalPipeOSPipe(t *testing.T) {
+	test.PipeOSPipeTest(t, Launcher{}, Launcher{}, true)
+}
+
+func TestLocalPipeline(t *testing.T) {
+	test.PipelineTest(t, Launcher{})
+}
+
+// Audit's executors aren't FileExecutors, so this exercises relaying.
+func TestLocalPipelineRelayed(t *testing.T) {
+	test.PipelineTest(t, piper.NewAudit(Launcher{}, ioutil.Discard, piper.AuditCounts))
+}
+
+func TestLocalSudo(t *testing.T) {
+	test.FakeSudo(t)
+	test.SudoTest(t, Launcher{})
+}
+
+func TestLocalSu(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("su needs a password unless run as root")
+	}
+	l := piper.Sudo{Launcher: Launcher{}, Method: piper.MethodSu}
+	stdout, _, err := piper.RunCmdStrInCapture(l, "id -u; cat", "hello")
+	if err != nil || stdout != "0\nhello" {
+		t.Errorf("expected %q, got %q, %v", "0\nhello", stdout, err)
+	}
+}
+
+func TestLocalContainerExec(t *testing.T) {
+	test.FakeRuntime(t)
+	test.ContainerExecTest(t, Launcher{})
+}
+
+func TestLocalChroot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("chroot needs root")
+	}
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "marker"), []byte("inside\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := piper.Chroot{Launcher: Launcher{}, Dir: "/"}
+	stdout, _, err := piper.RunCmdCapture(l, "cat "+piper.ShellQuote(dir+"/marker"))
+	if err != nil || stdout != "inside\n" {
+		t.Errorf("expected %q, got %q, %v", "inside\n", stdout, err)
+	}
+	if err := piper.RunCmd(piper.Chroot{Launcher: Launcher{}, Dir: dir}, "true"); err == nil {
+		t.Errorf("expected error running in a chroot with no shell")
+	}
+}
+
+func TestLocalNsenter(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("nsenter needs root")
+	}
+	l := piper.Nsenter{Launcher: Launcher{}, PID: os.Getpid(), Namespaces: []string{"mount", "uts"}}
+	stdout, _, err := piper.RunCmdStrInCapture(l, "cat", "hello")
+	if err != nil || stdout != "hello" {
+		t.Errorf("expected %q, got %q, %v", "hello", stdout, err)
+	}
+	if err := piper.RunCmd(piper.Nsenter{Launcher: Launcher{}, PID: os.Getpid(), Namespaces: []string{"bogus"}}, "true"); err == nil {
+		t.Errorf("expected error for unknown namespace")
+	}
+}
+
+func TestLocalTranscript(t *testing.T) {
+	test.TranscriptTest(t, Launcher{})
+}
+
+func TestLocalScan(t *testing.T) {
+	test.ScanTest(t, Launcher{})
+}
+
+func TestLocalJSON(t *testing.T) {
+	test.JSONTest(t, Launcher{})
+}
+
+func TestLocalPipeChecksum(t *testing.T) {
+	test.PipeChecksumTest(t, Launcher{}, Launcher{})
+}
+
+func TestLocalCaptureLimit(t *testing.T) {
+	test.CaptureLimitTest(t, Launcher{})
+}
+
+func TestLocalStderrFunc(t *testing.T) {
+	test.StderrFuncTest(t, Launcher{})
+}
+
+func TestLocalRetry(t *testing.T) {
+	test.RetryTest(t, Launcher{})
+}
+
+func TestLocalRunAll(t *testing.T) {
+	test.RunAllTest(t, Launcher{})
+}
+
+func TestLocalFanIn(t *testing.T) {
+	test.FanInTest(t, Launcher{})
+}
+
+func TestLocalAudit(t *testing.T) {
+	test.AuditTest(t, Launcher{})
+}
+
+func TestLocalConformance(t *testing.T) {
+	test.ConformanceTest(t, func(*testing.T) piper.Launcher { return Launcher{} })
+}
+
+func BenchmarkLocalPipe64M(b *testing.B) {
+	test.PipeBenchmark(b, Launcher{}, Launcher{}, 64<<20, piper.PipeOptions{})
+}
+
+func BenchmarkLocalPipe64MHashed(b *testing.B) {
+	test.PipeBenchmark(b, Launcher{}, Launcher{}, 64<<20, piper.PipeOptions{Hash: md5.New})
+}
+
+func BenchmarkLocalPipe64MBuffer32K(b *testing.B) {
+	test.PipeBenchmark(b, Launcher{}, Launcher{}, 64<<20, piper.PipeOptions{Hash: md5.New, BufferSize: 32 << 10})
+}
+
+func BenchmarkLocalPipe64MBuffer1M(b *testing.B) {
+	test.PipeBenchmark(b, Launcher{}, Launcher{}, 64<<20, piper.PipeOptions{Hash: md5.New, BufferSize: 1 << 20})
+}
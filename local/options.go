@@ -0,0 +1,76 @@
+package local
+
+type (
+	// Credential gives the user and groups to run commands as.
+	Credential struct {
+		Uid    uint32
+		Gid    uint32
+		Groups []uint32
+	}
+
+	// Resource identifies a resource limited by an Rlimit.
+	Resource int
+
+	// Rlimit limits a resource, as for setrlimit(2).
+	Rlimit struct {
+		Resource Resource
+		Cur      uint64
+		Max      uint64
+	}
+
+	// IOClass is an I/O scheduling class, as for ionice(1).
+	IOClass int
+
+	// Sandbox isolates commands using Linux namespaces.  Each command runs
+	// as root in a user namespace of its own, which grants no privileges
+	// outside it; see user_namespaces(7).  It also gets its own mount
+	// namespace, in which the host's filesystems are visible but read-only,
+	// and its own PID namespace, in which only its own processes are
+	// visible.  If the sandbox can't be set up the command exits with
+	// status 125 without having run.
+	Sandbox struct {
+		// Writable lists host paths that remain writable.  They must exist,
+		// and be absolute and free of symlinks.
+		Writable []string
+		// Network leaves commands in the host's network namespace.
+		// Otherwise they get one of their own, with no interfaces but
+		// loopback, which is down.
+		Network bool
+	}
+)
+
+// Resources that can be limited.
+const (
+	// RlimitCPU is CPU time in seconds.
+	RlimitCPU Resource = iota + 1
+	// RlimitFsize is the largest file that can be written, in bytes.
+	RlimitFsize
+	// RlimitNofile is one more than the highest file descriptor that can
+	// be opened.
+	RlimitNofile
+	// RlimitAS is the size of the address space, in bytes.
+	RlimitAS
+	// RlimitCore is the largest core file that can be written, in bytes.
+	RlimitCore
+	// RlimitNproc is the number of processes the user may have.
+	RlimitNproc
+)
+
+// RlimitInfinity is the absence of a limit.
+const RlimitInfinity = ^uint64(0)
+
+// I/O scheduling classes.
+const (
+	// IOClassNone leaves the I/O scheduling class alone.
+	IOClassNone IOClass = iota
+	IOClassRealtime
+	IOClassBestEffort
+	IOClassIdle
+)
+
+// hasOptions returns true if any of the options that need platform support
+// are set.
+func (l Launcher) hasOptions() bool {
+	return l.Credential != nil || len(l.Rlimits) > 0 || l.Nice != 0 ||
+		l.IOClass != IOClassNone || l.Pdeathsig != 0 || l.Sandbox != nil
+}
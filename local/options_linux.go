@@ -0,0 +1,126 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ncabatoff/piper"
+)
+
+// rlimit64 is struct rlimit64 as used by prlimit64(2).
+type rlimit64 struct {
+	Cur uint64
+	Max uint64
+}
+
+var resources = map[Resource]int{
+	RlimitCPU:    syscall.RLIMIT_CPU,
+	RlimitFsize:  syscall.RLIMIT_FSIZE,
+	RlimitNofile: syscall.RLIMIT_NOFILE,
+	RlimitAS:     syscall.RLIMIT_AS,
+	RlimitCore:   syscall.RLIMIT_CORE,
+	RlimitNproc:  6, // RLIMIT_NPROC, missing from package syscall
+}
+
+// ioprioWhoProcess and ioprioClassShift are from linux/ioprio.h.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// configure applies l's options to c.  Those that can't be applied via
+// SysProcAttr are returned as a function to apply them to the started
+// process, or nil if there are none.
+func (l Launcher) configure(c *exec.Cmd) (func(pid int) error, error) {
+	for _, rl := range l.Rlimits {
+		if _, ok := resources[rl.Resource]; !ok {
+			return nil, fmt.Errorf("unknown rlimit resource %d", rl.Resource)
+		}
+	}
+	if l.IOClass < IOClassNone || l.IOClass > IOClassIdle {
+		return nil, fmt.Errorf("unknown I/O class %d", l.IOClass)
+	}
+	if l.IOPriority < 0 || l.IOPriority > 7 {
+		return nil, fmt.Errorf("I/O priority %d not in 0-7", l.IOPriority)
+	}
+
+	if l.Credential != nil && l.Sandbox != nil {
+		return nil, fmt.Errorf("can't run sandboxed commands as another user")
+	}
+
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if cr := l.Credential; cr != nil {
+		c.SysProcAttr.Credential = &syscall.Credential{Uid: cr.Uid, Gid: cr.Gid, Groups: cr.Groups}
+	}
+	c.SysProcAttr.Pdeathsig = l.Pdeathsig
+	if c.SysProcAttr.Pdeathsig == 0 {
+		c.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	}
+	if sb := l.Sandbox; sb != nil {
+		sandbox(c, sb)
+	}
+	if len(l.Rlimits) == 0 && l.Nice == 0 && l.IOClass == IOClassNone {
+		return nil, nil
+	}
+
+	return func(pid int) error {
+		for _, rl := range l.Rlimits {
+			lim := rlimit64{Cur: rl.Cur, Max: rl.Max}
+			_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid),
+				uintptr(resources[rl.Resource]), uintptr(unsafe.Pointer(&lim)), 0, 0, 0)
+			if errno != 0 {
+				return fmt.Errorf("error setting rlimit %d to %d/%d: %v", rl.Resource, rl.Cur, rl.Max, errno)
+			}
+		}
+		if l.Nice != 0 {
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, l.Nice); err != nil {
+				return fmt.Errorf("error setting niceness to %d: %v", l.Nice, err)
+			}
+		}
+		if l.IOClass != IOClassNone {
+			prio := int(l.IOClass)<<ioprioClassShift | l.IOPriority
+			_, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(prio))
+			if errno != 0 {
+				return fmt.Errorf("error setting I/O class %d priority %d: %v", l.IOClass, l.IOPriority, errno)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// sandbox makes c run in the namespaces sb calls for, as root there, and
+// prepends to its script the commands to set up its view of the host.
+func sandbox(c *exec.Cmd, sb *Sandbox) {
+	c.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if !sb.Network {
+		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	c.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	c.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+
+	// Bind mount the writable paths onto themselves first, so that they
+	// have mounts of their own to be skipped when making the rest of the
+	// mounts read-only.  Then replace /proc with one for our PID
+	// namespace.
+	var b strings.Builder
+	skip := "''"
+	for _, p := range sb.Writable {
+		q := piper.ShellQuote(p)
+		fmt.Fprintf(&b, "mount --bind %s %s || exit 125\n", q, q)
+		skip += "|" + q
+	}
+	fmt.Fprintf(&b, `awk '{print $5}' /proc/self/mountinfo | while read -r mp; do
+	mp=$(printf '%%b' "$mp")
+	case "$mp" in %s) continue ;; esac
+	mount -o remount,bind,ro "$mp" || { echo "sandbox: can't make $mp read-only" >&2; exit 125; }
+done || exit 125
+mount -t proc proc /proc || exit 125
+`, skip)
+	c.Args[2] = b.String() + c.Args[2]
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package local
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// configure returns an error if any options are set, since they're only
+// supported on Linux.
+func (l Launcher) configure(c *exec.Cmd) (func(pid int) error, error) {
+	if l.hasOptions() {
+		return nil, fmt.Errorf("local launcher options aren't supported on %s", runtime.GOOS)
+	}
+	return nil, nil
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package local
+
+import "os/exec"
+
+func setpgid(cmd *exec.Cmd) {}
+
+func killgroup(cmd *exec.Cmd) error {
+	return nil
+}
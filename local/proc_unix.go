@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package local
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setpgid puts the command in a process group of its own, so that killgroup
+// can reach any children sh spawns as well as sh itself.
+func setpgid(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killgroup kills the process group of a started command.
+func killgroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		// Already gone.
+		return nil
+	}
+	return err
+}
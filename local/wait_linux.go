@@ -0,0 +1,26 @@
+package local
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// pPid and wNowait are from linux/wait.h.
+const (
+	pPid    = 1
+	wNowait = 0x01000000
+)
+
+// waitExited waits for the process pid to exit, without reaping it, and
+// returns true if it did.
+func waitExited(pid int) bool {
+	// waitid fills in a siginfo_t, which is 128 bytes.
+	var info [128]byte
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPid, uintptr(pid),
+			uintptr(unsafe.Pointer(&info[0])), syscall.WEXITED|wNowait, 0, 0)
+		if errno != syscall.EINTR {
+			return errno == 0
+		}
+	}
+}
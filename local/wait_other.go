@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package local
+
+// waitExited would wait for a process to exit without reaping it, but we
+// don't know how to do that here.
+func waitExited(pid int) bool {
+	return false
+}
@@ -0,0 +1,215 @@
+package piper
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type (
+	// ParallelOptions modifies how RunAll runs commands.
+	ParallelOptions struct {
+		// RunOptions apply to each command; in particular Timeout
+		// applies to each host separately.
+		RunOptions
+		// Concurrency bounds how many commands run at once.  Zero
+		// means no bound.
+		Concurrency int
+		// StopOnFailure means that once a command fails, those still
+		// running are killed and those not yet started aren't run.
+		StopOnFailure bool
+	}
+
+	// HostResult is the outcome of running a command via one launcher.
+	HostResult struct {
+		RunResult
+		// ExitStatus is as returned by the ExitStatus function.
+		ExitStatus int
+		Duration   time.Duration
+	}
+
+	// stopper wraps a launcher so that RunAll can kill the commands it
+	// has running once one fails, and keep the rest from starting.
+	stopper struct {
+		Launcher
+		s *stopState
+	}
+
+	// stopState tracks the commands launched via stoppers that haven't
+	// been waited on.
+	stopState struct {
+		mu      sync.Mutex
+		stopped bool
+		running map[*stopexe]struct{}
+	}
+
+	// stopexe is an executor launched via a stopper.
+	stopexe struct {
+		Executor
+		s *stopState
+		// mu guards the fields below, and is held while starting so that
+		// a Kill can't slip in between our check and the start.
+		mu      sync.Mutex
+		started bool
+		killed  bool
+	}
+)
+
+// ErrNotRun is the error given for commands RunAll didn't run because an
+// earlier command failed and StopOnFailure was set.
+var ErrNotRun = errors.New("not run due to an earlier failure")
+
+// ExitStatus returns the exit status of a command given the error it
+// returned: 0 for nil, and -1 if err doesn't report an exit status, e.g.
+// because the command was killed or never started.
+func ExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	// ssh.ExitError has ExitStatus, exec.ExitError has ExitCode.
+	var sshee interface{ ExitStatus() int }
+	if errors.As(err, &sshee) {
+		return sshee.ExitStatus()
+	}
+	var execee interface{ ExitCode() int }
+	if errors.As(err, &execee) {
+		return execee.ExitCode()
+	}
+	return -1
+}
+
+// RunAll runs cmd via each of lchs concurrently, returning the results keyed
+// by each launcher's String().  Launchers should thus describe themselves
+// uniquely, since only one result is kept per description.  Commands are
+// started in the order of lchs.
+func RunAll(lchs []Launcher, cmd string, opts ParallelOptions) map[string]HostResult {
+	var (
+		results = make(map[string]HostResult, len(lchs))
+		mu      sync.Mutex
+		failed  bool
+		wg      sync.WaitGroup
+		sem     chan struct{}
+		stop    = &stopState{running: make(map[*stopexe]struct{})}
+	)
+	if opts.Concurrency > 0 {
+		sem = make(chan struct{}, opts.Concurrency)
+	}
+	notRun := HostResult{RunResult: RunResult{Err: ErrNotRun}, ExitStatus: -1}
+
+	for _, lch := range lchs {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		mu.Lock()
+		skip := failed && opts.StopOnFailure
+		if skip {
+			results[lch.String()] = notRun
+		}
+		mu.Unlock()
+		if skip {
+			if sem != nil {
+				<-sem
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(lch Launcher) {
+			defer wg.Done()
+			run := lch
+			if opts.StopOnFailure {
+				run = stopper{lch, stop}
+			}
+			start := time.Now()
+			rr := RunCmdWith(run, cmd, opts.RunOptions)
+			hr := HostResult{RunResult: rr, ExitStatus: ExitStatus(rr.Err), Duration: time.Since(start)}
+			if errors.Is(rr.Err, ErrNotRun) {
+				hr = notRun
+			}
+			// Record the failure before freeing our slot, so that the
+			// next command isn't started in ignorance of it.
+			mu.Lock()
+			results[lch.String()] = hr
+			if rr.Err != nil && hr.Err != ErrNotRun {
+				failed = true
+				if opts.StopOnFailure {
+					stop.stop()
+				}
+			}
+			mu.Unlock()
+			if sem != nil {
+				<-sem
+			}
+		}(lch)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// Launch implements the Launcher interface.  Commands launched after stop
+// won't start.
+func (l stopper) Launch(cmd string) (Executor, error) {
+	exe, err := l.Launcher.Launch(cmd)
+	if err != nil {
+		return nil, err
+	}
+	e := &stopexe{Executor: exe, s: l.s}
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	e.killed = l.s.stopped
+	l.s.running[e] = struct{}{}
+	return e, nil
+}
+
+// stop kills the commands running and keeps any more from starting.
+func (s *stopState) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for e := range s.running {
+		e.Kill()
+	}
+}
+
+// Start implements the Executor interface.  It fails with ErrNotRun once
+// the command has been killed.
+func (e *stopexe) Start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.killed {
+		return ErrNotRun
+	}
+	err := e.Executor.Start()
+	e.started = err == nil
+	return err
+}
+
+// Run implements the Executor interface.
+func (e *stopexe) Run() error {
+	if err := e.Start(); err != nil {
+		return err
+	}
+	return e.Wait()
+}
+
+// Kill implements the Executor interface.
+func (e *stopexe) Kill() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.killed = true
+	if !e.started {
+		return nil
+	}
+	return e.Executor.Kill()
+}
+
+// Wait implements the Executor interface.  The command remains killable
+// until it has exited.
+func (e *stopexe) Wait() error {
+	err := e.Executor.Wait()
+	e.s.mu.Lock()
+	delete(e.s.running, e)
+	e.s.mu.Unlock()
+	return err
+}
@@ -0,0 +1,247 @@
+package piper
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type (
+	// PipelineOptions modifies how Pipeline runs its stages.  The zero
+	// value is fine.
+	PipelineOptions struct {
+		// CaptureLimit, if positive, bounds what's kept of each captured
+		// stream to its first and last CaptureLimit bytes.
+		CaptureLimit int
+		// StderrFunc, if non-nil, is called with each line any stage
+		// writes to stderr as it arrives, in addition to its being
+		// captured.  Calls are serialized.
+		StderrFunc func(StderrLine)
+	}
+
+	// PipelineResult summarizes the result of Pipeline.
+	PipelineResult struct {
+		// Stages holds the outcome of each stage, in order.
+		Stages []StageResult
+		// Stdout is what the last stage wrote to its stdout.
+		Stdout string
+		// StdoutDropped counts the bytes left out of the middle of Stdout
+		// due to PipelineOptions.CaptureLimit.
+		StdoutDropped int64
+		Err           error
+	}
+
+	// StageResult is the outcome of one stage of a Pipeline.
+	StageResult struct {
+		Stderr        string
+		StderrDropped int64
+		// Err is the error from the stage's command exiting, if any.
+		// When a stage fails the stages before it are killed, so they'll
+		// generally have an Err too.
+		Err error
+		// OSPipe is true if this stage's stdout was connected to the next
+		// stage's stdin by an OS pipe; see PipeResult.OSPipe.
+		OSPipe bool
+		// Bytes is the number of bytes we relayed from this stage's
+		// stdout to the next stage's stdin.  It's zero for the last stage
+		// and for stages connected by an OS pipe.
+		Bytes int64
+	}
+
+	// stage is one running command of a pipeline.
+	stage struct {
+		Launchable
+		exe Executor
+		// stdout, if non-nil, is relayed to the next stage's stdin, or
+		// captured if this is the last stage.
+		stdout io.Reader
+		// stdin, if non-nil, is fed from the previous stage's stdout.
+		stdin  io.WriteCloser
+		stderr io.Reader
+	}
+)
+
+// stageName returns the StderrLine Stage for stage i of n.
+func stageName(i, n int) string {
+	switch {
+	case n == 1:
+		return StageCmd
+	case i == 0:
+		return StageSource
+	case i == n-1:
+		return StageSink
+	}
+	return StageFilter
+}
+
+// Pipeline runs stages as in a shell pipeline, feeding each one's stdout to
+// the next one's stdin, and captures the stderr of each and the stdout of
+// the last.  As with Pipe, adjacent stages whose executors are both
+// FileExecutors are connected by an OS pipe; otherwise we relay the data.
+func Pipeline(stages []Launchable, opts PipelineOptions) PipelineResult {
+	if len(stages) == 0 {
+		return PipelineResult{Err: fmt.Errorf("empty pipeline")}
+	}
+	ps, ospipes, err := pipelineSetup(stages)
+	if err != nil {
+		closeFiles(ospipes)
+		return PipelineResult{Err: &StartError{err}}
+	}
+
+	for i, s := range ps {
+		if err := s.exe.Start(); err != nil {
+			closeFiles(ospipes)
+			for _, started := range ps[:i] {
+				_ = started.exe.Kill()
+				_ = started.exe.Wait()
+			}
+			releaseStages(ps[i:])
+			return PipelineResult{Err: &StartError{s.exe.Errorf("error starting pipeline stage %d: %w", i, err)}}
+		}
+	}
+	// The stages have their own copies of the OS pipes now, and ours
+	// would stop readers from seeing EOF.
+	closeFiles(ospipes)
+
+	pr := PipelineResult{Stages: make([]StageResult, len(ps))}
+	lines := newLineFunc(opts.StderrFunc)
+	stdout := newCapture(opts.CaptureLimit)
+	stderrs := make([]*capture, len(ps))
+	errchan := make(chan error)
+	n := 0
+	for i, s := range ps {
+		stderrs[i] = newCapture(opts.CaptureLimit)
+		go copyClose(lines.writer(stderrs[i], stageName(i, len(ps)), s.Launcher), s.stderr, errchan)
+		n++
+		switch {
+		case i == len(ps)-1:
+			go copyClose(stdout, s.stdout, errchan)
+			n++
+		case s.stdout == nil:
+			pr.Stages[i].OSPipe = true
+		default:
+			go func(i int, src, snk *stage) {
+				errchan <- relay(src, snk, &pr.Stages[i].Bytes)
+			}(i, s, ps[i+1])
+			n++
+		}
+	}
+	var errs []error
+	for ; n > 0; n-- {
+		if err := <-errchan; err != nil {
+			errs = append(errs, fmt.Errorf("error piping: %w", err))
+		}
+	}
+
+	// Wait on every stage at once, killing those upstream of any that
+	// fail so that they don't block writing to it.
+	waitchans := make([]chan error, len(ps))
+	for i, s := range ps {
+		waitchans[i] = make(chan error, 1)
+		go func(i int, s *stage) {
+			err := s.exe.Wait()
+			if err != nil {
+				err = fmt.Errorf("stage %d exited with error: %w", i, err)
+				for _, up := range ps[:i] {
+					up.exe.Kill()
+				}
+			}
+			waitchans[i] <- err
+		}(i, s)
+	}
+	for i := range ps {
+		sr := &pr.Stages[i]
+		sr.Err = <-waitchans[i]
+		sr.Stderr, sr.StderrDropped = stderrs[i].String(), stderrs[i].dropped
+		errs = append(errs, sr.Err)
+	}
+	pr.Stdout, pr.StdoutDropped = stdout.String(), stdout.dropped
+	pr.Err = joinerrs("; ", errs...)
+	return pr
+}
+
+// pipelineSetup launches the stages and connects their streams, returning
+// them along with any OS pipe ends we must close.
+func pipelineSetup(stages []Launchable) ([]*stage, []*os.File, error) {
+	ps := make([]*stage, len(stages))
+	var ospipes []*os.File
+	// fail releases the stages launched so far and returns err.
+	fail := func(err error) ([]*stage, []*os.File, error) {
+		releaseStages(ps)
+		return nil, ospipes, err
+	}
+	for i, l := range stages {
+		exe, err := l.LaunchCmd()
+		if err != nil {
+			return fail(l.Errorf("error creating pipeline stage %d: %w", i, err))
+		}
+		ps[i] = &stage{Launchable: l, exe: exe}
+		ps[i].stderr, err = exe.StderrPipe()
+		if err != nil {
+			return fail(exe.Errorf("error opening stderr pipe: %w", err))
+		}
+	}
+
+	for i, s := range ps {
+		if i == len(ps)-1 {
+			var err error
+			if s.stdout, err = s.exe.StdoutPipe(); err != nil {
+				return fail(s.exe.Errorf("error opening stdout pipe: %w", err))
+			}
+			break
+		}
+		next := ps[i+1]
+		srcf, srcok := s.exe.(FileExecutor)
+		snkf, snkok := next.exe.(FileExecutor)
+		if srcok && snkok {
+			r, w, err := os.Pipe()
+			if err == nil {
+				ospipes = append(ospipes, r, w)
+				srcf.SetStdout(w)
+				snkf.SetStdin(r)
+				continue
+			}
+		}
+		var err error
+		if s.stdout, err = s.exe.StdoutPipe(); err != nil {
+			return fail(s.exe.Errorf("error opening stdout pipe: %w", err))
+		}
+		if next.stdin, err = next.exe.StdinPipe(); err != nil {
+			return fail(next.exe.Errorf("error creating stdin pipe: %w", err))
+		}
+	}
+	return ps, ospipes, nil
+}
+
+// releaseStages releases the executors of stages that were launched but
+// won't be started; ps may have trailing nils.
+func releaseStages(ps []*stage) {
+	for _, s := range ps {
+		if s != nil {
+			release(s.exe)
+		}
+	}
+}
+
+// relay copies src's stdout to snk's stdin, storing the bytes copied in n.
+// If that fails src is killed, since nothing more can reach snk.
+func relay(src, snk *stage, n *int64) error {
+	buf := copyBuffers.Get().([]byte)
+	defer copyBuffers.Put(buf)
+	var err error
+	*n, err = io.CopyBuffer(snk.stdin, src.stdout, buf)
+	snk.stdin.Close()
+	if err != nil {
+		src.exe.Kill()
+		io.Copy(ioutil.Discard, src.stdout)
+	}
+	return err
+}
+
+// closeFiles closes fs.
+func closeFiles(fs []*os.File) {
+	for _, f := range fs {
+		f.Close()
+	}
+}
@@ -1,9 +1,15 @@
 package piper
 
 import (
-	"bytes"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
@@ -53,7 +59,10 @@ type (
 		// An error returns if the command is killed, or returns a non-zero exit code.
 		// Failing to Wait() will result in resource leaks.  There is no need to close
 		// stdout/stderr pipes provided Wait() is called.  Wait() should not be
-		// called until all output pipes have been fully consumed.
+		// called until all output pipes have been fully consumed.  Wait() may
+		// also be called on a command that was never started, or whose Start()
+		// failed, to release what Launch acquired for it (e.g. an ssh
+		// session); it then returns an error without blocking.
 		Wait() error
 		// Kill terminates a command that has been Start()ed.  It returns an error if it
 		// encountered one while doing so.  There is no hard guarantee that if it has
@@ -62,6 +71,26 @@ type (
 		Kill() error
 	}
 
+	// A RemoteShell is a Launcher whose commands can also be reached from a
+	// shell on some other host, e.g. via ssh(1).
+	RemoteShell interface {
+		Launcher
+		// ShellCommand returns a shell command which, when run on
+		// another host, runs cmd via this launcher's host.
+		ShellCommand(cmd string) string
+	}
+
+	// A FileExecutor is an Executor whose process can be handed an OS file
+	// to use as its stdin or stdout, instead of a pipe to our process.
+	// Pipe uses this to connect two such commands with an OS pipe so that
+	// the data never passes through us.  SetStdin and SetStdout must be
+	// called before Start, and instead of StdinPipe and StdoutPipe.
+	FileExecutor interface {
+		Executor
+		SetStdin(f *os.File)
+		SetStdout(f *os.File)
+	}
+
 	// Verbose() wraps an existing launcher to describe what it does, and what
 	// any Executor it builds does.  This includes Run, Start, Wait, and Kill
 	// activities.
@@ -132,11 +161,56 @@ func (ve verbexe) Kill() error {
 
 type (
 	harness struct {
-		exe    Executor
-		errs   chan error
-		stdin  *string
-		stdout *string
-		stderr *string
+		exe     Executor
+		errs    chan error
+		stdin   io.Reader
+		stdout  io.Writer
+		stderr  io.Writer
+		timeout time.Duration
+	}
+
+	// RunOptions modifies how RunCmdWith runs a command.  The zero value
+	// gives the behaviour of RunCmd.
+	RunOptions struct {
+		// Stdin, if non-nil, is written to the command's standard input.
+		Stdin *string
+		// StdinReader, if non-nil, is copied to the command's standard
+		// input instead of Stdin, e.g. os.Stdin.  It's read until EOF
+		// even if the command exits first.
+		StdinReader io.Reader
+		// Capture makes the command's stdout and stderr available in the
+		// RunResult; otherwise they're discarded unless Stdout or
+		// StderrFunc is given.
+		Capture bool
+		// Stdout, if non-nil, receives the command's stdout as it
+		// arrives, whether or not it's captured.
+		Stdout io.Writer
+		// CaptureLimit, if positive, bounds what's kept of stdout and
+		// stderr to their first and last CaptureLimit bytes each.
+		CaptureLimit int
+		// StderrFunc, if non-nil, is called with each line the command
+		// writes to stderr as it arrives, whether or not it's captured.
+		StderrFunc func(StderrLine)
+		// Timeout, if positive, is how long the command may run before
+		// it's killed.
+		Timeout time.Duration
+		// Transcript makes the RunResult include a Transcript of stdout
+		// and stderr combined, whether or not they're also captured
+		// separately.  CaptureLimit applies to it as a whole.
+		Transcript bool
+	}
+
+	// RunResult summarizes the result of RunCmdWith.
+	RunResult struct {
+		Stdout string
+		Stderr string
+		// StdoutDropped and StderrDropped count the bytes left out of
+		// the middle of Stdout and Stderr due to RunOptions.CaptureLimit.
+		StdoutDropped int64
+		StderrDropped int64
+		// Transcript is set if RunOptions.Transcript was.
+		Transcript Transcript
+		Err        error
 	}
 )
 
@@ -147,7 +221,7 @@ func newHarness(exe Executor) *harness {
 func startCmd(lch Launcher, cmd string) (*harness, error) {
 	exe, err := lch.Launch(cmd)
 	if err != nil {
-		return nil, lch.Errorf("error starting %s: %v", cmd, err)
+		return nil, &StartError{lch.Errorf("error starting %s: %w", cmd, err)}
 	}
 
 	return newHarness(exe), nil
@@ -155,114 +229,163 @@ func startCmd(lch Launcher, cmd string) (*harness, error) {
 
 // RunCmd executes cmd using lch, discarding any output.
 func RunCmd(lch Launcher, cmd string) error {
-	h, err := startCmd(lch, cmd)
-	if err != nil {
-		return err
-	}
-	return h.run()
+	return RunCmdWith(lch, cmd, RunOptions{}).Err
 }
 
 func RunCmdStrIn(lch Launcher, cmd, stdin string) error {
-	h, err := startCmd(lch, cmd)
-	if err != nil {
-		return err
-	}
-	h.stdin = &stdin
-	return h.run()
+	return RunCmdWith(lch, cmd, RunOptions{Stdin: &stdin}).Err
 }
 
 // Capture executes exe and returns the stdout and stderr output it produces.
 func RunCmdCapture(lch Launcher, cmd string) (stdout string, stderr string, err error) {
-	h, err := startCmd(lch, cmd)
-	if err != nil {
-		return "", "", err
-	}
-	h.stdout, h.stderr = &stdout, &stderr
-	err = h.run()
-	return
+	rr := RunCmdWith(lch, cmd, RunOptions{Capture: true})
+	return rr.Stdout, rr.Stderr, rr.Err
 }
 
 func RunCmdStrInCapture(lch Launcher, cmd, stdin string) (stdout string, stderr string, err error) {
+	rr := RunCmdWith(lch, cmd, RunOptions{Stdin: &stdin, Capture: true})
+	return rr.Stdout, rr.Stderr, rr.Err
+}
+
+// RunCmdWith executes cmd using lch as directed by opts.
+func RunCmdWith(lch Launcher, cmd string, opts RunOptions) RunResult {
 	h, err := startCmd(lch, cmd)
 	if err != nil {
-		return "", "", err
+		return RunResult{Err: err}
+	}
+	h.timeout = opts.Timeout
+	switch {
+	case opts.StdinReader != nil:
+		h.stdin = opts.StdinReader
+	case opts.Stdin != nil:
+		h.stdin = strings.NewReader(*opts.Stdin)
+	}
+	var stdout, stderr *capture
+	if opts.Capture {
+		stdout, stderr = newCapture(opts.CaptureLimit), newCapture(opts.CaptureLimit)
+		h.stdout, h.stderr = stdout, stderr
+	}
+	if opts.Stdout != nil {
+		h.stdout = teeWriter(h.stdout, opts.Stdout)
+	}
+	var tr *transcriber
+	if opts.Transcript {
+		tr = newTranscriber(opts.CaptureLimit)
+		h.stdout = teeWriter(h.stdout, tr.writer(StreamStdout))
+		h.stderr = teeWriter(h.stderr, tr.writer(StreamStderr))
+	}
+	if opts.StderrFunc != nil {
+		w := h.stderr
+		if w == nil {
+			w = ioutil.Discard
+		}
+		h.stderr = newLineFunc(opts.StderrFunc).writer(w, StageCmd, lch)
 	}
-	h.stdin, h.stdout, h.stderr = &stdin, &stdout, &stderr
-	err = h.run()
-	return
+
+	rr := RunResult{Err: h.run()}
+	if opts.Capture {
+		rr.Stdout, rr.StdoutDropped = stdout.String(), stdout.dropped
+		rr.Stderr, rr.StderrDropped = stderr.String(), stderr.dropped
+	}
+	if tr != nil {
+		rr.Transcript = tr.transcript()
+	}
+	return rr
+}
+
+// release frees what was acquired for exe, which was launched but won't be
+// started.
+func release(exe Executor) {
+	_ = exe.Wait()
+}
+
+// A flusher is a writer that may hold back some of what's written to it
+// until Flush is called, e.g. an unterminated line.
+type flusher interface {
+	Flush() error
 }
 
 // copyClose is a helper method to write rc to w.  Once rc is exhausted or a write
-// error occurs, a nil or an error is written to errs.
+// error occurs, w is flushed if it's a flusher, and a nil or an error is
+// written to errs.
 func copyClose(w io.Writer, rc io.Reader, errs chan error) {
 	_, err := io.Copy(w, rc)
-	errs <- err
-}
-
-func copyCloseStr(dest *string, rc io.Reader, errs chan error) {
-	var w bytes.Buffer
-	_, err := io.Copy(&w, rc)
-	*dest = w.String()
+	if f, ok := w.(flusher); ok {
+		if ferr := f.Flush(); err == nil {
+			err = ferr
+		}
+	}
 	errs <- err
 }
 
 // CaptureIn executes exe, writing the string stdin to the exe's standard input.
 // Returns the stdout and stderr output produced.
 func (h harness) run() error {
-	var errchan = make(chan error)
+	// errchan is buffered so that the copies never block on it, even if
+	// we return before reading it.
+	var errchan = make(chan error, 3)
 	// The size of errs determines how many reads we'll do from errchan.
 	var errs = make([]error, 0, 3)
 
 	var pstdout, pstderr io.ReadCloser
+	var pstdin io.WriteCloser
 	var err error
+	// fail closes whatever pipes are open, releases exe and returns err.
+	fail := func(err error) error {
+		for _, c := range []io.Closer{pstdout, pstderr, pstdin} {
+			if c != nil {
+				c.Close()
+			}
+		}
+		release(h.exe)
+		return &StartError{err}
+	}
 
 	if h.stdout != nil {
-		pstdout, err = h.exe.StdoutPipe()
-		if err != nil {
-			return h.exe.Errorf("error opening stdout pipe: %v", err)
+		if pstdout, err = h.exe.StdoutPipe(); err != nil {
+			return fail(h.exe.Errorf("error opening stdout pipe: %w", err))
 		}
-		errs = errs[:len(errs)+1]
-		go func() {
-			copyCloseStr(h.stdout, pstdout, errchan)
-		}()
 	}
 	if h.stderr != nil {
-		pstderr, err = h.exe.StderrPipe()
-		if err != nil {
-			if pstdout != nil {
-				pstdout.Close()
-			}
-			return h.exe.Errorf("error opening stderr pipe: %v", err)
+		if pstderr, err = h.exe.StderrPipe(); err != nil {
+			return fail(h.exe.Errorf("error opening stderr pipe: %w", err))
 		}
-		errs = errs[:len(errs)+1]
-		go func() {
-			copyCloseStr(h.stderr, pstderr, errchan)
-		}()
 	}
-
 	if h.stdin != nil {
-		pstdin, err := h.exe.StdinPipe()
-		if err != nil {
-			if pstdout != nil {
-				pstdout.Close()
-			}
-			if pstderr != nil {
-				pstderr.Close()
-			}
-			return h.exe.Errorf("error opening stdin pipe: %v", err)
+		if pstdin, err = h.exe.StdinPipe(); err != nil {
+			return fail(h.exe.Errorf("error opening stdin pipe: %w", err))
 		}
+	}
+
+	// The copies only begin once the exe has started, so that nothing is
+	// read from stdin on behalf of a command that never ran.
+	if err := h.exe.Start(); err != nil {
+		return fail(h.exe.Errorf("error starting: %w", err))
+	}
+
+	if pstdout != nil {
+		errs = errs[:len(errs)+1]
+		go copyClose(h.stdout, pstdout, errchan)
+	}
+	if pstderr != nil {
+		errs = errs[:len(errs)+1]
+		go copyClose(h.stderr, pstderr, errchan)
+	}
+	if pstdin != nil {
+		errs = errs[:len(errs)+1]
 		go func() {
-			copyClose(pstdin, bytes.NewBuffer([]byte(*h.stdin)), errchan)
+			copyClose(pstdin, h.stdin, errchan)
 			pstdin.Close()
 		}()
-		errs = errs[:len(errs)+1]
 	}
 
-	// The expectation is that Start() will close open fds
-	// associated with the exe (e.g. from StdoutPipe) if it
-	// returns an error.
-	if err := h.exe.Start(); err != nil {
-		return h.exe.Errorf("error starting: %v", err)
+	var timedout int32
+	if h.timeout > 0 {
+		timer := time.AfterFunc(h.timeout, func() {
+			atomic.StoreInt32(&timedout, 1)
+			h.exe.Kill()
+		})
+		defer timer.Stop()
 	}
 
 	// Ok, we have a running exe now.  Capture stdout and stderr, and collect
@@ -276,8 +399,10 @@ func (h harness) run() error {
 	// unlikely (impossible?) that we get errors on them without getting an
 	// error from Wait().  But just in case, we'll handle that possibility.
 	err = h.exe.Wait()
-	if err != nil {
-		err = h.exe.Errorf("completed with error: %v", err)
+	if err != nil && atomic.LoadInt32(&timedout) != 0 {
+		err = h.exe.Errorf("killed after timeout of %v: %w", h.timeout, err)
+	} else if err != nil {
+		err = h.exe.Errorf("completed with error: %w", err)
 	} else {
 		for _, e := range errs {
 			if e != nil {
@@ -297,7 +422,7 @@ type (
 		// stdout emits what exe writes to its stdout.
 		stdout io.Reader
 		// stderr stores what exe writes to its stderr.
-		stderr bytes.Buffer
+		stderr *capture
 		// errchan is written to once exe's stderr is closed: an error on
 		// failure, nil on success.
 		errchan <-chan error
@@ -309,17 +434,81 @@ type (
 		// stdin is fed into exe's stdin.
 		stdin io.WriteCloser
 		// stdout stores what exe writes to its stdout.
-		stdout bytes.Buffer
+		stdout *capture
 		// stderr stores what exe writes to its stderr.
-		stderr bytes.Buffer
+		stderr *capture
 		// errchan is written to once exe's stderr is closed: an error on
 		// failure, nil on success.  Same goes for stdout.
 		errchan <-chan error
 	}
 
 	pipe struct {
-		src *source
-		snk *sink
+		src  *source
+		snk  *sink
+		opts PipeOptions
+		// meter tallies the data passing from src to snk.
+		meter *meter
+	}
+
+	// PipeOptions modifies how Pipe moves data from source to sink.  The
+	// zero value gives the plain behaviour of Pipe.
+	PipeOptions struct {
+		// Codec, if non-nil, compresses the stream between source and
+		// sink.  By default its commands run on the source and sink
+		// hosts, so only compressed data travels between them.
+		Codec *Codec
+		// CompressHere makes us compress the stream in-process with
+		// Codec.NewWriter after reading it from the source, instead of
+		// running Codec.Compress on the source host.  Useful when the
+		// source is local and the sink is remote.
+		CompressHere bool
+		// DecompressHere makes us decompress the stream in-process with
+		// Codec.NewReader before writing it to the sink, instead of
+		// running Codec.Decompress on the sink host.  Useful when the
+		// source is remote and the sink is local.
+		DecompressHere bool
+		// Direct asks for the data to flow straight from the source host
+		// to the sink host rather than being relayed through our process.
+		// Both launchers must be RemoteShells, and the source host must
+		// be able to run the sink's ShellCommand non-interactively (e.g.
+		// it has a key the sink host accepts).  If either isn't the case
+		// Pipe falls back to relaying.  It also relays if Hash, Verify,
+		// Progress, Relay, CompressHere or DecompressHere are given, since
+		// they need the data to pass through our process.  When the
+		// transfer is direct, the sink's stderr arrives mixed into
+		// SrcStderr.
+		Direct bool
+		// Hash, if non-nil, creates a hash used to compute
+		// PipeResult.Digest, e.g. sha256.New.
+		Hash func() hash.Hash
+		// Verify, if non-nil, gives commands to compute a digest on each
+		// side once the pipe has succeeded.  A mismatch is an error.  The
+		// data is relayed, so that Bytes and Digest are there to check.
+		Verify *Verify
+		// CaptureLimit, if positive, bounds what's kept of each captured
+		// stream to its first and last CaptureLimit bytes.
+		CaptureLimit int
+		// StderrFunc, if non-nil, is called with each line either command
+		// writes to stderr as it arrives, in addition to its being
+		// captured.  Calls are serialized.
+		StderrFunc func(StderrLine)
+		// Progress, if non-nil, is called with the running total of bytes
+		// relayed each time more have been read from the source.  Asking
+		// for progress means the data must be relayed; see PipeResult.OSPipe.
+		Progress func(n int64)
+		// Stdout, if non-nil, receives the sink's stdout as it arrives,
+		// in addition to its being captured.
+		Stdout io.Writer
+		// Relay makes the data pass through our process even if nothing
+		// else calls for it, so that Bytes counts it.  Retry sets it to
+		// tell whether a failed pipe got as far as moving any data.
+		Relay bool
+		// BufferSize, if positive, is the size of the buffer used to relay
+		// data through our process; the default is 128KiB.  It has no
+		// effect when the data can be spliced from source to sink without
+		// a buffer, i.e. when both are local and nothing is being done to
+		// the data in transit.
+		BufferSize int
 	}
 
 	// PipeResult summarizes the result of a pipe by giving the stderr of the source,
@@ -330,6 +519,36 @@ type (
 		SnkStderr string
 		SnkStdout string
 		Err       error
+		// SrcErr and SnkErr are the parts of Err, if any, that come from
+		// the source and sink commands exiting unsuccessfully.  Note that
+		// when the sink fails the source is killed, so both will be set.
+		// They're nil for Direct pipes.
+		SrcErr error
+		SnkErr error
+		// Direct is true if the data went straight from source host to
+		// sink host; see PipeOptions.Direct.
+		Direct bool
+		// OSPipe is true if the source and sink were connected by an OS
+		// pipe, so the data never passed through our process and Bytes
+		// is zero.  This happens when both commands are FileExecutors
+		// (e.g. both are local) and nothing calls for the data to be
+		// relayed: no Hash, Verify, Progress, Relay, or in-process
+		// compression.
+		OSPipe bool
+		// Bytes is the number of bytes that passed through our process
+		// on their way from source to sink: after in-process
+		// decompression and before in-process compression.  It's zero if
+		// OSPipe or Direct is true, since then no data passed through us.
+		Bytes int64
+		// Digest is the hex encoded hash of the bytes counted by Bytes,
+		// if PipeOptions.Hash was given.
+		Digest string
+		// SrcStderrDropped, SnkStderrDropped and SnkStdoutDropped count
+		// the bytes left out of the middle of the corresponding fields
+		// due to PipeOptions.CaptureLimit.
+		SrcStderrDropped int64
+		SnkStderrDropped int64
+		SnkStdoutDropped int64
 	}
 )
 
@@ -337,78 +556,157 @@ type (
 func pipesout(exe Executor) (io.Reader, io.Reader, error) {
 	pstdout, err := exe.StdoutPipe()
 	if err != nil {
-		return nil, nil, exe.Errorf("error opening stdout pipe: %v", err)
+		return nil, nil, exe.Errorf("error opening stdout pipe: %w", err)
 	}
 	pstderr, err := exe.StderrPipe()
 	if err != nil {
 		pstdout.Close()
-		return nil, nil, exe.Errorf("error opening stderr pipe: %v", err)
+		return nil, nil, exe.Errorf("error opening stderr pipe: %w", err)
 	}
 	return pstdout, pstderr, nil
 }
 
-// send creates and returns a source.  The exe contained therein will have already
+// send creates and returns a source, whose stderr is written to stderrw (either
+// stderr itself or something that writes to it).  The exe contained therein will have already
 // had Start() called on it.  Once a single value has been read from errchan it is
 // safe to call exe.Wait, which is necessary to avoid resource leaks.
-func send(exe Executor) (*source, error) {
-	stdout, stderr, err := pipesout(exe)
+//
+// If ospipe is non-nil it becomes exe's stdout, and is closed once exe has
+// started, in which case the source's stdout is nil.
+func send(exe Executor, stderr *capture, stderrw io.Writer, ospipe *os.File) (*source, error) {
+	var pstdout, pstderr io.Reader
+	var err error
+	if ospipe != nil {
+		defer ospipe.Close()
+		exe.(FileExecutor).SetStdout(ospipe)
+		pstderr, err = exe.StderrPipe()
+		if err != nil {
+			err = exe.Errorf("error opening stderr pipe: %w", err)
+		}
+	} else {
+		pstdout, pstderr, err = pipesout(exe)
+	}
 	if err != nil {
 		return nil, err
 	}
 	err = exe.Start()
 	if err != nil {
-		return nil, exe.Errorf("error starting pipe source: %v", err)
+		return nil, exe.Errorf("error starting pipe source: %w", err)
 	}
 
 	errchan := make(chan error)
-	src := &source{exe: exe, stdout: stdout, errchan: errchan}
-	go copyClose(&src.stderr, stderr, errchan)
+	src := &source{exe: exe, stdout: pstdout, stderr: stderr, errchan: errchan}
+	go copyClose(stderrw, pstderr, errchan)
 	return src, nil
 }
 
-// recv creates and returns a sink.  The exe contained therein will have already
+// recv creates and returns a sink, whose stderr is written to stderrw (either
+// stderr itself or something that writes to it).  The exe contained therein will have already
 // had Start() called on it.  Once two values have been read from errchan it is
 // safe to call exe.Wait, which is necessary to avoid resource leaks.
-func recv(exe Executor) (*sink, error) {
-	stdout, stderr, err := pipesout(exe)
+//
+// If ospipe is non-nil it becomes exe's stdin, and is closed once exe has
+// started, in which case the sink's stdin discards anything written to it.
+func recv(exe Executor, stdout, stderr *capture, stdoutw, stderrw io.Writer, ospipe *os.File) (*sink, error) {
+	if ospipe != nil {
+		defer ospipe.Close()
+	}
+	pstdout, pstderr, err := pipesout(exe)
 	if err != nil {
 		return nil, err
 	}
-	stdin, err := exe.StdinPipe()
-	if err != nil {
-		return nil, exe.Errorf("error creating stdin pipe: %v", err)
+	var stdin io.WriteCloser
+	if ospipe != nil {
+		exe.(FileExecutor).SetStdin(ospipe)
+		stdin = nopWriteCloser{ioutil.Discard}
+	} else {
+		stdin, err = exe.StdinPipe()
+		if err != nil {
+			return nil, exe.Errorf("error creating stdin pipe: %w", err)
+		}
 	}
 	err = exe.Start()
 	if err != nil {
-		return nil, exe.Errorf("error starting pipe sink: %v", err)
+		return nil, exe.Errorf("error starting pipe sink: %w", err)
 	}
 
 	errchan := make(chan error)
-	snk := &sink{exe: exe, stdin: stdin, errchan: errchan}
-	go copyClose(&snk.stderr, stderr, errchan)
-	go copyClose(&snk.stdout, stdout, errchan)
+	snk := &sink{exe: exe, stdin: stdin, stdout: stdout, stderr: stderr, errchan: errchan}
+	go copyClose(stderrw, pstderr, errchan)
+	go copyClose(stdoutw, pstdout, errchan)
 	return snk, nil
 }
 
 // Pipe invokes two commands and connects the stdout of the source
 // to the stdin of the sink.
 func Pipe(srclch, snklch Launchable) PipeResult {
+	return PipeWith(srclch, snklch, PipeOptions{})
+}
+
+// PipeWith is like Pipe but accepts options.
+func PipeWith(srclch, snklch Launchable, opts PipeOptions) PipeResult {
+	if c := opts.Codec; c != nil {
+		if opts.CompressHere && c.NewWriter == nil || opts.DecompressHere && c.NewReader == nil {
+			return PipeResult{Err: fmt.Errorf("codec %s doesn't support in-process use", c.Name)}
+		}
+		if opts.CompressHere && opts.DecompressHere {
+			// We'd compress and decompress the same stream, so the codec
+			// would be pointless, and copy has no way to do both.
+			return PipeResult{Err: fmt.Errorf("can't both compress and decompress in-process")}
+		}
+		if !opts.CompressHere {
+			srclch.Cmd = c.compressCmd(srclch.Cmd)
+		}
+		if !opts.DecompressHere {
+			snklch.Cmd = c.decompressCmd(snklch.Cmd)
+		}
+	}
+
+	pr := pipeLaunch(srclch, snklch, opts)
+	if opts.Verify != nil && pr.Err == nil {
+		pr.Err = opts.Verify.check(srclch.Launcher, snklch.Launcher, pr, opts)
+	}
+	return pr
+}
+
+// pipeLaunch does the work of PipeWith once the commands are final.
+func pipeLaunch(srclch, snklch Launchable, opts PipeOptions) PipeResult {
+	if opts.Direct && !opts.relayed() {
+		if pr, ok := pipeDirect(srclch, snklch, opts); ok {
+			return pr
+		}
+	}
+
 	srcexe, err := srclch.LaunchCmd()
 	if err != nil {
-		return PipeResult{Err: srclch.Errorf("error creating pipe source: %v", err)}
+		return PipeResult{Err: &StartError{srclch.Errorf("error creating pipe source: %w", err)}}
 	}
 
 	snkexe, err := snklch.LaunchCmd()
 	if err != nil {
-		return PipeResult{Err: snklch.Errorf("error creating pipe sink: %v", err)}
+		release(srcexe)
+		return PipeResult{Err: &StartError{snklch.Errorf("error creating pipe sink: %w", err)}}
 	}
 
-	src, err := send(srcexe)
+	ospr, ospw := osPipe(srcexe, snkexe, opts)
+	lines := newLineFunc(opts.StderrFunc)
+	srcstderr := newCapture(opts.CaptureLimit)
+	src, err := send(srcexe, srcstderr, lines.writer(srcstderr, StageSource, srclch.Launcher), ospw)
 	if err != nil {
-		return PipeResult{Err: err}
+		if ospr != nil {
+			ospr.Close()
+		}
+		release(srcexe)
+		release(snkexe)
+		return PipeResult{Err: &StartError{err}}
 	}
 
-	snk, err := recv(snkexe)
+	snkstdout, snkstderr := newCapture(opts.CaptureLimit), newCapture(opts.CaptureLimit)
+	var snkstdoutw io.Writer = snkstdout
+	if opts.Stdout != nil {
+		snkstdoutw = teeWriter(opts.Stdout, snkstdout)
+	}
+	snk, err := recv(snkexe, snkstdout, snkstderr, snkstdoutw, lines.writer(snkstderr, StageSink, snklch.Launcher), ospr)
 	if err != nil {
 		// We won't bother reporting on errs produced during src shutdown, since
 		// the sink never even started up successfully; that's the error we want
@@ -417,17 +715,163 @@ func Pipe(srclch, snklch Launchable) PipeResult {
 		// TODO once we support writing to stdin on the source, we must close stdin
 		// before waiting.
 		_ = src.exe.Wait()
+		release(snkexe)
 		return PipeResult{Err: err}
 	}
 
-	return pipe{src, snk}.run()
+	pr := pipe{src, snk, opts, newMeter(opts.Hash, opts.Progress)}.run()
+	pr.OSPipe = ospr != nil
+	return pr
+}
+
+// osPipe returns the read and write ends of an OS pipe with which to
+// connect srcexe and snkexe, or nils if the data must be relayed.
+func osPipe(srcexe, snkexe Executor, opts PipeOptions) (*os.File, *os.File) {
+	if opts.relayed() {
+		return nil, nil
+	}
+	if _, ok := srcexe.(FileExecutor); !ok {
+		return nil, nil
+	}
+	if _, ok := snkexe.(FileExecutor); !ok {
+		return nil, nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		// Relaying will do just as well, if a little slower.
+		return nil, nil
+	}
+	return r, w
+}
+
+// relayed returns true if opts call for the data to pass through our
+// process, so that neither Direct nor an OS pipe can be used.
+func (opts PipeOptions) relayed() bool {
+	return opts.Hash != nil || opts.Verify != nil || opts.Progress != nil || opts.Relay ||
+		opts.CompressHere || opts.DecompressHere
+}
+
+// nopWriteCloser adds a no-op Close to a Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close implements io.Closer.
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// pipeDirect tries to run the pipe entirely on the source host, which
+// reaches the sink host itself.  It returns false if that isn't possible,
+// in which case nothing has been run apart from a connectivity probe.
+func pipeDirect(srclch, snklch Launchable, opts PipeOptions) (PipeResult, bool) {
+	if _, ok := srclch.Launcher.(RemoteShell); !ok {
+		return PipeResult{}, false
+	}
+	snkrsh, ok := snklch.Launcher.(RemoteShell)
+	if !ok {
+		return PipeResult{}, false
+	}
+	if err := RunCmd(srclch.Launcher, snkrsh.ShellCommand("true")); err != nil {
+		return PipeResult{}, false
+	}
+
+	cmd := shellPipeline(srclch.Cmd, snkrsh.ShellCommand(snklch.Cmd))
+	ropts := RunOptions{Capture: true, CaptureLimit: opts.CaptureLimit, Stdout: opts.Stdout}
+	if fn := opts.StderrFunc; fn != nil {
+		ropts.StderrFunc = func(l StderrLine) {
+			l.Stage = StageSource
+			fn(l)
+		}
+	}
+	rr := RunCmdWith(srclch.Launcher, cmd, ropts)
+	if rr.Err != nil {
+		rr.Err = fmt.Errorf("direct pipe to %s: %w", snkrsh, rr.Err)
+	}
+	return PipeResult{
+		SrcStderr:        rr.Stderr,
+		SrcStderrDropped: rr.StderrDropped,
+		SnkStdout:        rr.Stdout,
+		SnkStdoutDropped: rr.StdoutDropped,
+		Err:              rr.Err,
+		Direct:           true,
+	}, true
+}
+
+// copyBufferSize is the default PipeOptions.BufferSize.
+const copyBufferSize = 128 << 10
+
+// copyBuffers holds buffers of copyBufferSize for reuse across pipes.
+var copyBuffers = sync.Pool{New: func() interface{} { return make([]byte, copyBufferSize) }}
+
+// copy moves the source's stdout to the sink's stdin, compressing or
+// decompressing it in-process along the way if so configured.
+func (p pipe) copy() error {
+	if p.src.stdout == nil {
+		// The source and sink are connected by an OS pipe.
+		return nil
+	}
+	var r io.Reader = p.src.stdout
+	var w io.Writer = p.snk.stdin
+	c := p.opts.Codec
+	if c != nil && p.opts.DecompressHere {
+		dr, err := c.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%s decompression: %v", c.Name, err)
+		}
+		defer dr.Close()
+		r = dr
+	}
+	// Only tee when hashing: wrapping the reader would otherwise hide
+	// the *os.File beneath it from io.CopyBuffer and defeat splicing.
+	if p.meter.h != nil || p.meter.progress != nil {
+		r = io.TeeReader(r, p.meter)
+	}
+	var buf []byte
+	if p.opts.BufferSize > 0 {
+		buf = make([]byte, p.opts.BufferSize)
+	} else {
+		buf = copyBuffers.Get().([]byte)
+		defer copyBuffers.Put(buf)
+	}
+	if c != nil && p.opts.CompressHere {
+		cw, err := c.NewWriter(w)
+		if err != nil {
+			return fmt.Errorf("%s compression: %v", c.Name, err)
+		}
+		n, err := io.CopyBuffer(cw, r, buf)
+		p.count(n)
+		if err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	}
+	n, err := io.CopyBuffer(w, r, buf)
+	p.count(n)
+	return err
+}
+
+// count adds n bytes copied to the meter, unless it saw them already.
+func (p pipe) count(n int64) {
+	if p.meter.h == nil && p.meter.progress == nil {
+		p.meter.n += n
+	}
 }
 
 // readandwrite does all the I/O but stops short of the Wait.
 func (p pipe) readandwrite() error {
 	errs := make(chan error)
 	go func() {
-		_, err := io.Copy(p.snk.stdin, p.src.stdout)
+		err := p.copy()
+		if err != nil {
+			// Nothing more can reach the sink, so stop the source,
+			// but keep draining it so that it (or any child that
+			// survives the kill) doesn't block forever writing to a
+			// pipe nobody reads.
+			p.src.exe.Kill()
+			io.Copy(ioutil.Discard, p.src.stdout)
+		}
 		errs <- err
 	}()
 
@@ -440,18 +884,18 @@ func (p pipe) readandwrite() error {
 		select {
 		case err = <-errs:
 			if err != nil {
-				err = fmt.Errorf("error piping: %v", err)
+				err = fmt.Errorf("error piping: %w", err)
 			}
 			dones++
 			p.snk.stdin.Close()
 		case srcerr := <-p.src.errchan:
 			if srcerr != nil {
-				err = fmt.Errorf("source error: %v", srcerr)
+				err = fmt.Errorf("source error: %w", srcerr)
 			}
 			dones++
 		case snkerr := <-p.snk.errchan:
 			if snkerr != nil {
-				err = fmt.Errorf("sink error: %v", snkerr)
+				err = fmt.Errorf("sink error: %w", snkerr)
 			}
 			dones++
 		}
@@ -459,49 +903,74 @@ func (p pipe) readandwrite() error {
 	return err
 }
 
+// errlist is a sep-separated list of errors which can still be inspected
+// with errors.Is and errors.As.
+type errlist struct {
+	sep  string
+	errs []error
+}
+
+// Error implements error.
+func (el errlist) Error() string {
+	errstr := ""
+	for _, e := range el.errs {
+		errstr += fmt.Sprintf("%s%v", el.sep, e)
+	}
+	return errstr[len(el.sep):]
+}
+
+// Unwrap returns the errors in the list.
+func (el errlist) Unwrap() []error {
+	return el.errs
+}
+
 // joinerrs returns nil if all errs are nil, otherwise a sep-separated
 // concatenation of all non-nil errs.
 func joinerrs(sep string, errs ...error) error {
-	errstr := ""
+	var nonnil []error
 	for _, e := range errs {
 		if e != nil {
-			errstr += fmt.Sprintf("%s%v", sep, e)
+			nonnil = append(nonnil, e)
 		}
 	}
-	if len(errstr) > 0 {
-		return fmt.Errorf("%v", errstr[len(sep):])
+	if len(nonnil) > 0 {
+		return errlist{sep, nonnil}
 	}
 	return nil
 }
 
-func (p pipe) wait() error {
+// wait returns the errors from waiting on the source and the sink.
+func (p pipe) wait() (error, error) {
 	// Order in which source/sink exit unspecified, so spawn goroutines
-	// to collect the results and sync via channel.
-	waitchan := make(chan error)
+	// to collect the results.
+	srcchan, snkchan := make(chan error), make(chan error)
 	go func() {
 		err := p.src.exe.Wait()
 		if err != nil {
-			err = fmt.Errorf("source exited with error: %v", err)
+			err = fmt.Errorf("source exited with error: %w", err)
 		}
-		waitchan <- err
+		srcchan <- err
 	}()
 	go func() {
 		err := p.snk.exe.Wait()
 		if err != nil {
-			err = fmt.Errorf("sink exited with error: %v", err)
+			err = fmt.Errorf("sink exited with error: %w", err)
 			p.src.exe.Kill()
 		}
-		waitchan <- err
+		snkchan <- err
 	}()
 
-	return joinerrs("; ", <-waitchan, <-waitchan)
+	return <-srcchan, <-snkchan
 }
 
 func (p pipe) run() PipeResult {
-	pr := PipeResult{Err: joinerrs("; ", p.readandwrite(), p.wait())}
-	pr.SrcStderr = p.src.stderr.String()
-	pr.SnkStderr = p.snk.stderr.String()
-	pr.SnkStdout = p.snk.stdout.String()
+	rwerr := p.readandwrite()
+	srcerr, snkerr := p.wait()
+	pr := PipeResult{Err: joinerrs("; ", rwerr, srcerr, snkerr), SrcErr: srcerr, SnkErr: snkerr}
+	pr.SrcStderr, pr.SrcStderrDropped = p.src.stderr.String(), p.src.stderr.dropped
+	pr.SnkStderr, pr.SnkStderrDropped = p.snk.stderr.String(), p.snk.stderr.dropped
+	pr.SnkStdout, pr.SnkStdoutDropped = p.snk.stdout.String(), p.snk.stdout.dropped
+	pr.Bytes, pr.Digest = p.meter.n, p.meter.digest()
 
 	return pr
 }
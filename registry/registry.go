@@ -0,0 +1,271 @@
+// Package registry keeps an inventory of named hosts, each with tags, and
+// hands out Launchers for them.  Launchers are created when first asked for
+// and shared by everyone asking for the same host, until the last of them
+// is closed.
+//
+// Hosts are selected by name, e.g. "db-primary", or by tag, e.g.
+// "tag:backup", which selects every host with that tag.
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ncabatoff/piper"
+	"github.com/ncabatoff/piper/spec"
+)
+
+// TagPrefix starts a selector that picks hosts by tag rather than name.
+const TagPrefix = "tag:"
+
+type (
+	// Definition describes a host in the inventory.
+	Definition struct {
+		spec.Host
+		Tags []string `json:"tags,omitempty"`
+	}
+
+	// Registry maps host names to Definitions and their Launchers.  Create
+	// it with New or Load.
+	Registry struct {
+		// Dial creates the Launcher for a host.  It defaults to calling
+		// the Definition's Launcher method, which refuses ssh hosts whose
+		// keys aren't listed in their known_hosts file.
+		Dial func(name string, def Definition) (piper.Launcher, error)
+
+		mu      sync.Mutex
+		entries map[string]*entry
+	}
+
+	// entry is a host's Definition and its Launcher, if it's in use.
+	entry struct {
+		def Definition
+		// mu guards the fields below, and is held while dialing so that
+		// only one Launcher is created per host.
+		mu   sync.Mutex
+		lch  piper.Launcher
+		refs int
+		// gen counts the Launchers created, so that handles to one that's
+		// since been closed can be recognized.
+		gen int
+	}
+
+	// handle is what Get hands out: a reference to a shared Launcher.
+	handle struct {
+		piper.Launcher
+		e    *entry
+		gen  int
+		once sync.Once
+	}
+
+	// shellHandle is a handle to a Launcher that's also a RemoteShell.
+	shellHandle struct {
+		*handle
+		rsh piper.RemoteShell
+	}
+)
+
+// New returns an empty Registry.
+func New() *Registry {
+	return &Registry{entries: make(map[string]*entry)}
+}
+
+// Load reads a Registry from a JSON object mapping host names to
+// Definitions, e.g.
+//
+//	{"db-primary": {"type": "ssh", "host": "db1", "tags": ["db", "backup"]}}
+func Load(r io.Reader) (*Registry, error) {
+	var defs map[string]Definition
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&defs); err != nil {
+		return nil, fmt.Errorf("error loading registry: %v", err)
+	}
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	reg := New()
+	for _, name := range names {
+		if err := reg.Add(name, defs[name]); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+// Add defines a host.  Names must be unique, and may not start with
+// TagPrefix.
+func (r *Registry) Add(name string, def Definition) error {
+	if name == "" || strings.HasPrefix(name, TagPrefix) {
+		return fmt.Errorf("invalid host name %q", name)
+	}
+	if err := def.Validate(); err != nil {
+		return fmt.Errorf("host %q: %w", name, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[name]; ok {
+		return fmt.Errorf("host %q already defined", name)
+	}
+	r.entries[name] = &entry{def: def}
+	return nil
+}
+
+// Names returns the sorted names of the hosts selected by sel, which is
+// either a host name or TagPrefix followed by a tag.  It's an error for
+// sel to select no hosts.
+func (r *Registry) Names(sel string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !strings.HasPrefix(sel, TagPrefix) {
+		if _, ok := r.entries[sel]; !ok {
+			return nil, fmt.Errorf("unknown host %q", sel)
+		}
+		return []string{sel}, nil
+	}
+	tag := strings.TrimPrefix(sel, TagPrefix)
+	var names []string
+	for name, e := range r.entries {
+		for _, t := range e.def.Tags {
+			if t == tag {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no hosts tagged %q", tag)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Get returns a Launcher for the named host, creating it if it's not
+// already in use.  The caller must Close the returned Launcher when done
+// with it; the underlying Launcher is closed once every Launcher Get has
+// returned for it has been.  If the underlying Launcher is a RemoteShell,
+// so is the one returned.
+func (r *Registry) Get(name string) (piper.Launcher, error) {
+	r.mu.Lock()
+	e, ok := r.entries[name]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown host %q", name)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lch == nil {
+		dial := r.Dial
+		if dial == nil {
+			dial = func(_ string, def Definition) (piper.Launcher, error) {
+				return def.Launcher()
+			}
+		}
+		lch, err := dial(name, e.def)
+		if err != nil {
+			return nil, fmt.Errorf("host %q: %w", name, err)
+		}
+		e.lch = lch
+		e.gen++
+	}
+	e.refs++
+
+	h := &handle{Launcher: e.lch, e: e, gen: e.gen}
+	if rsh, ok := e.lch.(piper.RemoteShell); ok {
+		return shellHandle{h, rsh}, nil
+	}
+	return h, nil
+}
+
+// Resolve returns Launchers for the hosts selected by sel, as for Names,
+// in the order Names gives.  Each must be closed as for Get.  If any can't
+// be created, those that were are closed and an error is returned.
+func (r *Registry) Resolve(sel string) ([]piper.Launcher, error) {
+	names, err := r.Names(sel)
+	if err != nil {
+		return nil, err
+	}
+	lchs := make([]piper.Launcher, 0, len(names))
+	for _, name := range names {
+		lch, err := r.Get(name)
+		if err != nil {
+			for _, l := range lchs {
+				l.Close()
+			}
+			return nil, err
+		}
+		lchs = append(lchs, lch)
+	}
+	return lchs, nil
+}
+
+// InUse returns the number of open Launchers Get has returned for the
+// named host.
+func (r *Registry) InUse(name string) int {
+	r.mu.Lock()
+	e, ok := r.entries[name]
+	r.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.refs
+}
+
+// Close closes every underlying Launcher, whether or not the Launchers
+// returned by Get have been closed.  Closing those afterwards is harmless.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []string
+	for name, e := range r.entries {
+		e.mu.Lock()
+		if e.lch != nil {
+			if err := e.lch.Close(); err != nil {
+				errs = append(errs, fmt.Sprintf("host %q: %v", name, err))
+			}
+			e.lch, e.refs = nil, 0
+		}
+		e.mu.Unlock()
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("error closing registry: %v", errs)
+	}
+	return nil
+}
+
+// Close implements the piper.Launcher interface by releasing h, closing
+// the underlying Launcher if nothing else is using it.  Closing h more
+// than once has no further effect.
+func (h *handle) Close() error {
+	var err error
+	h.once.Do(func() {
+		h.e.mu.Lock()
+		defer h.e.mu.Unlock()
+		// The registry may have been closed, and perhaps the host
+		// redialed, since h was handed out.
+		if h.e.lch == nil || h.e.gen != h.gen {
+			return
+		}
+		h.e.refs--
+		if h.e.refs == 0 {
+			err = h.e.lch.Close()
+			h.e.lch = nil
+		}
+	})
+	return err
+}
+
+// ShellCommand implements the piper.RemoteShell interface.
+func (h shellHandle) ShellCommand(cmd string) string {
+	return h.rsh.ShellCommand(cmd)
+}
@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ncabatoff/piper"
+	"github.com/ncabatoff/piper/fake"
+	"github.com/ncabatoff/piper/spec"
+	"github.com/ncabatoff/piper/test"
+	"golang.org/x/crypto/ssh"
+)
+
+const inventory = `{
+	"db-primary": {"type": "ssh", "host": "db1", "tags": ["db", "backup"]},
+	"db-replica": {"type": "ssh", "host": "db2", "port": 2222, "tags": ["db"]},
+	"files":      {"type": "ssh", "host": "files", "user": "bob", "tags": ["backup"]},
+	"here":       {"type": "local"}
+}`
+
+// remote is a fake Launcher that's also a RemoteShell.
+type remote struct {
+	fake.Launcher
+}
+
+func (r remote) ShellCommand(cmd string) string {
+	return "ssh " + r.Name + " " + piper.ShellQuote(cmd)
+}
+
+// fakeRegistry returns the inventory, with fake Launchers standing in for
+// ssh ones, and a record of the fakes dialed.
+func fakeRegistry(t *testing.T) (*Registry, *[]fake.Launcher) {
+	reg, err := Load(strings.NewReader(inventory))
+	if err != nil {
+		t.Fatalf("error loading registry: %v", err)
+	}
+	var mu sync.Mutex
+	var dialed []fake.Launcher
+	reg.Dial = func(name string, def Definition) (piper.Launcher, error) {
+		if def.Type != "ssh" {
+			return def.Launcher()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		l := fake.NewLauncher(name)
+		dialed = append(dialed, l)
+		return remote{l}, nil
+	}
+	return reg, &dialed
+}
+
+func TestNames(t *testing.T) {
+	reg, _ := fakeRegistry(t)
+	for sel, want := range map[string][]string{
+		"here":       {"here"},
+		"tag:db":     {"db-primary", "db-replica"},
+		"tag:backup": {"db-primary", "files"},
+	} {
+		got, err := reg.Names(sel)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Names(%q) = %q, %v; expected %q", sel, got, err, want)
+		}
+	}
+	for _, sel := range []string{"nosuch", "tag:nosuch", ""} {
+		if _, err := reg.Names(sel); err == nil {
+			t.Errorf("Names(%q) returned no error", sel)
+		}
+	}
+}
+
+func TestGetShared(t *testing.T) {
+	reg, dialed := fakeRegistry(t)
+	l1, err := reg.Get("db-primary")
+	if err != nil {
+		t.Fatalf("error getting launcher: %v", err)
+	}
+	l2, err := reg.Get("db-primary")
+	if err != nil {
+		t.Fatalf("error getting launcher: %v", err)
+	}
+	if len(*dialed) != 1 || reg.InUse("db-primary") != 2 {
+		t.Errorf("expected one launcher used twice, got %d used %d times", len(*dialed), reg.InUse("db-primary"))
+	}
+	if _, ok := l1.(piper.RemoteShell); !ok {
+		t.Errorf("expected a RemoteShell")
+	}
+
+	l1.Close()
+	l1.Close()
+	if (*dialed)[0].Closed() || reg.InUse("db-primary") != 1 {
+		t.Errorf("launcher closed while still in use")
+	}
+	l2.Close()
+	if !(*dialed)[0].Closed() || reg.InUse("db-primary") != 0 {
+		t.Errorf("launcher not closed once unused")
+	}
+
+	l3, err := reg.Get("db-primary")
+	if err != nil {
+		t.Fatalf("error getting launcher: %v", err)
+	}
+	defer l3.Close()
+	if len(*dialed) != 2 {
+		t.Errorf("expected launcher to be redialed, got %d dials", len(*dialed))
+	}
+}
+
+func TestResolve(t *testing.T) {
+	reg, dialed := fakeRegistry(t)
+	lchs, err := reg.Resolve("tag:backup")
+	if err != nil {
+		t.Fatalf("error resolving: %v", err)
+	}
+	var names []string
+	for _, l := range lchs {
+		names = append(names, l.String())
+	}
+	if want := []string{"fake:db-primary", "fake:files"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected %q, got %q", want, names)
+	}
+
+	reg.Close()
+	for _, l := range *dialed {
+		if !l.Closed() {
+			t.Errorf("%s not closed by registry Close", l)
+		}
+	}
+	// Closing handles after the registry is harmless.
+	for _, l := range lchs {
+		l.Close()
+	}
+}
+
+func TestResolveFailure(t *testing.T) {
+	reg, dialed := fakeRegistry(t)
+	dial := reg.Dial
+	reg.Dial = func(name string, def Definition) (piper.Launcher, error) {
+		if name == "files" {
+			return nil, errors.New("connection refused")
+		}
+		return dial(name, def)
+	}
+	if _, err := reg.Resolve("tag:backup"); err == nil || !strings.Contains(err.Error(), "files") {
+		t.Errorf("expected error from files, got %v", err)
+	}
+	if len(*dialed) != 1 || !(*dialed)[0].Closed() {
+		t.Errorf("expected db-primary to be dialed and then closed")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	reg, _ := fakeRegistry(t)
+	defer reg.Close()
+	lch, err := reg.Get("here")
+	if err != nil {
+		t.Fatalf("error getting launcher: %v", err)
+	}
+	defer lch.Close()
+	if stdout, _, err := piper.RunCmdCapture(lch, "echo hello"); err != nil || stdout != "hello\n" {
+		t.Errorf("expected hello, got %q, %v", stdout, err)
+	}
+}
+
+func TestHostKeyMismatch(t *testing.T) {
+	addr, hostKey := test.SSHServer(t)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "id")
+	test.WriteSSHKey(t, key)
+	for name, k := range map[string]ssh.PublicKey{"right": hostKey, "wrong": otherKey} {
+		entry := "[" + host + "]:" + port + " " + string(ssh.MarshalAuthorizedKey(k))
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(entry), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	def := `{"type": "ssh", "host": %q, "port": %s, "user": "nobody", "key": %q, "known_hosts": %q}`
+	reg, err := Load(strings.NewReader(fmt.Sprintf(`{"good": `+def+`, "bad": `+def+`}`,
+		host, port, key, filepath.Join(dir, "right"), host, port, key, filepath.Join(dir, "wrong"))))
+	if err != nil {
+		t.Fatalf("error loading registry: %v", err)
+	}
+	defer reg.Close()
+	if _, err := reg.Get("bad"); err == nil || !strings.Contains(err.Error(), "host key mismatch") {
+		t.Errorf("expected a host key mismatch, got %v", err)
+	}
+	if n := reg.InUse("bad"); n != 0 {
+		t.Errorf("expected a refused host not to be in use, got %d", n)
+	}
+	lch, err := reg.Get("good")
+	if err != nil {
+		t.Fatalf("error getting host with a listed key: %v", err)
+	}
+	lch.Close()
+}
+
+func TestAddInvalid(t *testing.T) {
+	reg := New()
+	local := Definition{Host: spec.Host{Type: spec.TypeLocal}}
+	for _, tc := range []struct {
+		name string
+		def  Definition
+	}{
+		{"", local},
+		{"tag:x", local},
+		{"notype", Definition{Tags: []string{"x"}}},
+		{"badport", Definition{Host: spec.Host{Type: spec.TypeSSH, Address: "x", Port: -1}}},
+	} {
+		if err := reg.Add(tc.name, tc.def); err == nil {
+			t.Errorf("Add(%q) returned no error", tc.name)
+		}
+	}
+	if err := reg.Add("here", local); err != nil {
+		t.Errorf("error adding host: %v", err)
+	}
+	if err := reg.Add("here", local); err == nil {
+		t.Errorf("adding duplicate host returned no error")
+	}
+}
@@ -0,0 +1,180 @@
+package replay
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/piper"
+)
+
+type (
+	// Recorder wraps an existing launcher to record a Session of what's
+	// run with it, for later playback by a replay Launcher.
+	Recorder struct {
+		piper.Launcher
+		*recording
+	}
+
+	recording struct {
+		mu      sync.Mutex
+		session Session
+	}
+
+	// recexe is a wrapping executor that records what passes through it.
+	recexe struct {
+		piper.Executor
+		r     Recorder
+		index int
+		// mu guards the fields below, which are written to from the
+		// goroutines consuming the pipes.
+		mu     sync.Mutex
+		start  time.Time
+		stdin  *bytes.Buffer
+		stdout []Chunk
+		stderr []Chunk
+	}
+
+	recReader struct {
+		io.ReadCloser
+		e      *recexe
+		chunks *[]Chunk
+	}
+
+	recWriter struct {
+		io.WriteCloser
+		e *recexe
+	}
+)
+
+// errNotWaited is the error recorded for commands never waited for.
+const errNotWaited = "not waited for"
+
+// NewRecorder returns a Recorder wrapping lch; the session will be given
+// description.
+func NewRecorder(lch piper.Launcher, description string) Recorder {
+	return Recorder{Launcher: lch, recording: &recording{session: Session{Description: description}}}
+}
+
+// Session returns what's been recorded so far.  Commands that haven't yet
+// been waited for, including any that were killed and abandoned, are
+// included as having failed with exit status -1, since replaying them as
+// successes would be misleading.
+func (r Recorder) Session() Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.session
+	s.Commands = append([]Command(nil), s.Commands...)
+	return s
+}
+
+// Launch implements piper.Launcher.  Commands are recorded in the order
+// they're launched, since that's the order a replay will expect them in.
+// Failed launches aren't recorded.
+func (r Recorder) Launch(cmd string) (piper.Executor, error) {
+	exe, err := r.Launcher.Launch(cmd)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.session.Commands = append(r.session.Commands, Command{Command: cmd, ExitStatus: -1, Error: errNotWaited})
+	return &recexe{Executor: exe, r: r, index: len(r.session.Commands) - 1}, nil
+}
+
+func (rr recReader) Read(p []byte) (int, error) {
+	n, err := rr.ReadCloser.Read(p)
+	if n > 0 {
+		rr.e.mu.Lock()
+		// Copy p since the caller may reuse it.
+		data := append([]byte(nil), p[:n]...)
+		*rr.chunks = append(*rr.chunks, Chunk{Offset: time.Since(rr.e.start), Data: data})
+		rr.e.mu.Unlock()
+	}
+	return n, err
+}
+
+func (rw recWriter) Write(p []byte) (int, error) {
+	n, err := rw.WriteCloser.Write(p)
+	rw.e.mu.Lock()
+	rw.e.stdin.Write(p[:n])
+	rw.e.mu.Unlock()
+	return n, err
+}
+
+// StdinPipe implements piper.Executor.
+func (e *recexe) StdinPipe() (io.WriteCloser, error) {
+	w, err := e.Executor.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	e.stdin = &bytes.Buffer{}
+	return recWriter{w, e}, nil
+}
+
+// StdoutPipe implements piper.Executor.
+func (e *recexe) StdoutPipe() (io.ReadCloser, error) {
+	r, err := e.Executor.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	return recReader{r, e, &e.stdout}, nil
+}
+
+// StderrPipe implements piper.Executor.
+func (e *recexe) StderrPipe() (io.ReadCloser, error) {
+	r, err := e.Executor.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	return recReader{r, e, &e.stderr}, nil
+}
+
+// Start implements piper.Executor.
+func (e *recexe) Start() error {
+	e.mu.Lock()
+	e.start = time.Now()
+	e.mu.Unlock()
+	return e.Executor.Start()
+}
+
+// Run implements piper.Executor.
+func (e *recexe) Run() error {
+	e.mu.Lock()
+	e.start = time.Now()
+	e.mu.Unlock()
+	err := e.Executor.Run()
+	e.finished(err)
+	return err
+}
+
+// Wait implements piper.Executor.
+func (e *recexe) Wait() error {
+	err := e.Executor.Wait()
+	e.finished(err)
+	return err
+}
+
+// finished stores the command's recording in the session.
+func (e *recexe) finished(err error) {
+	e.mu.Lock()
+	cmd := Command{
+		Command:    e.Command(),
+		Stdout:     e.stdout,
+		Stderr:     e.stderr,
+		ExitStatus: piper.ExitStatus(err),
+		Duration:   time.Since(e.start),
+	}
+	if e.stdin != nil {
+		cmd.Stdin = append([]byte{}, e.stdin.Bytes()...)
+	}
+	e.mu.Unlock()
+	if err != nil {
+		cmd.Error = err.Error()
+	}
+
+	e.r.mu.Lock()
+	defer e.r.mu.Unlock()
+	e.r.session.Commands[e.index] = cmd
+}
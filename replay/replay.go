@@ -0,0 +1,344 @@
+// Package replay provides a piper.Launcher that plays back a recorded
+// Session instead of running commands, and a Recorder that captures a
+// Session from any other Launcher.  Together they allow deterministic tests
+// of code built on piper without spawning processes or reaching an sshd.
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/piper"
+)
+
+type (
+	// Session is a recording of the commands launched by a Launcher, in
+	// the order they were launched.
+	Session struct {
+		Description string    `json:"description"`
+		Commands    []Command `json:"commands"`
+	}
+
+	// Command is a recording of one command.
+	Command struct {
+		Command string `json:"command"`
+		// Stdin is what was written to the command's stdin, or nil if
+		// no stdin pipe was opened.  Like Chunk.Data it's base64 in JSON,
+		// where null and "" keep the two cases apart.
+		Stdin  []byte  `json:"stdin"`
+		Stdout []Chunk `json:"stdout,omitempty"`
+		Stderr []Chunk `json:"stderr,omitempty"`
+		// ExitStatus is as returned by piper.ExitStatus from Wait or Run,
+		// or -1 if the command was never waited for.
+		ExitStatus int `json:"exit_status"`
+		// Error is the error text from Wait or Run, if any.
+		Error string `json:"error,omitempty"`
+		// Duration is the time from Start to the completion of Wait.
+		Duration time.Duration `json:"duration"`
+	}
+
+	// Chunk is one read's worth of output.  Data is base64 in JSON, so
+	// output that isn't valid UTF-8 survives being saved.
+	Chunk struct {
+		// Offset is the time since Start at which the chunk was read.
+		Offset time.Duration `json:"offset"`
+		Data   []byte        `json:"data"`
+	}
+
+	// ExitError is returned by a replayed Wait or Run when the recorded
+	// command failed.
+	ExitError struct {
+		Status int
+		Msg    string
+	}
+)
+
+// Error implements error.
+func (e ExitError) Error() string {
+	return e.Msg
+}
+
+// ExitStatus returns the recorded exit status, for use by piper.ExitStatus.
+func (e ExitError) ExitStatus() int {
+	return e.Status
+}
+
+// Load reads a Session saved as JSON by Save.
+func Load(r io.Reader) (Session, error) {
+	var s Session
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return Session{}, fmt.Errorf("error loading replay session: %v", err)
+	}
+	return s, nil
+}
+
+// Save writes s as JSON.
+func (s Session) Save(w io.Writer) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+type (
+	// Launcher implements piper.Launcher by playing back a Session.  Each
+	// Launch must be for the next command in the session; anything else
+	// fails, as does a command being fed different stdin from what was
+	// recorded.  Such failures are also remembered and reported by Err,
+	// so they can't be lost by code that ignores errors.  Create it with
+	// NewLauncher; the zero value plays back nothing.
+	Launcher struct {
+		*state
+		// Realtime makes output arrive with the recorded timing, rather
+		// than all at once.
+		Realtime bool
+	}
+
+	state struct {
+		mu      sync.Mutex
+		session Session
+		next    int
+		errs    []error
+	}
+
+	// exe implements piper.Executor by playing back a Command.
+	exe struct {
+		cmd      Command
+		l        Launcher
+		stdinr   *io.PipeReader
+		stdinw   *io.PipeWriter
+		stdoutr  *io.PipeReader
+		stdoutw  *io.PipeWriter
+		stderrr  *io.PipeReader
+		stderrw  *io.PipeWriter
+		done     chan struct{}
+		killed   chan struct{}
+		killonce sync.Once
+		stdin    bytes.Buffer
+		// piped records which of stdin, stdout and stderr were asked
+		// for; the others behave as if connected to /dev/null.
+		piped map[string]bool
+		// started is set by Start.
+		started bool
+	}
+)
+
+// NewLauncher returns a Launcher that plays back s.
+func NewLauncher(s Session) Launcher {
+	return Launcher{state: &state{session: s}}
+}
+
+// fail records err and returns it.
+func (l Launcher) fail(err error) error {
+	if l.state == nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = append(l.errs, err)
+	return err
+}
+
+// Err returns an error describing all the ways in which what was run
+// deviated from the session, or nil if nothing did.
+func (l Launcher) Err() error {
+	if l.state == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("replay of %q failed: %v", l.session.Description, l.errs)
+}
+
+// Done returns Err, or an error if any commands in the session haven't
+// been launched.
+func (l Launcher) Done() error {
+	if err := l.Err(); err != nil {
+		return err
+	}
+	if l.state == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.next < len(l.session.Commands) {
+		return fmt.Errorf("replay of %q incomplete: next expected command is %q",
+			l.session.Description, l.session.Commands[l.next].Command)
+	}
+	return nil
+}
+
+// String implements the piper.Launcher interface.
+func (l Launcher) String() string {
+	if l.state == nil {
+		return "replay:"
+	}
+	return "replay:" + l.session.Description
+}
+
+// Errorf implements the piper.Launcher interface.
+func (l Launcher) Errorf(pat string, args ...interface{}) error {
+	return fmt.Errorf("%s: %w", l, fmt.Errorf(pat, args...))
+}
+
+// Close implements the piper.Launcher interface.
+func (l Launcher) Close() error {
+	return nil
+}
+
+// Launch implements the piper.Launcher interface by returning an Executor
+// for the next command in the session, provided it's cmd.
+func (l Launcher) Launch(cmd string) (piper.Executor, error) {
+	if l.state == nil {
+		return nil, fmt.Errorf("unexpected command %q: no session", cmd)
+	}
+	l.mu.Lock()
+	if l.next >= len(l.session.Commands) {
+		l.mu.Unlock()
+		return nil, l.fail(fmt.Errorf("unexpected command %q: session has ended", cmd))
+	}
+	rec := l.session.Commands[l.next]
+	if rec.Command != cmd {
+		l.mu.Unlock()
+		return nil, l.fail(fmt.Errorf("unexpected command %q: expected %q", cmd, rec.Command))
+	}
+	l.next++
+	l.mu.Unlock()
+
+	e := &exe{cmd: rec, l: l, done: make(chan struct{}), killed: make(chan struct{}), piped: make(map[string]bool)}
+	e.stdinr, e.stdinw = io.Pipe()
+	e.stdoutr, e.stdoutw = io.Pipe()
+	e.stderrr, e.stderrw = io.Pipe()
+	return e, nil
+}
+
+// Command implements the piper.Executor interface.
+func (e *exe) Command() string {
+	return e.cmd.Command
+}
+
+// Errorf implements the piper.Executor interface.
+func (e *exe) Errorf(pat string, args ...interface{}) error {
+	pfx := fmt.Sprintf("cmd %s{%s} :", e.l, e.cmd.Command)
+	return fmt.Errorf("%s: %w", pfx, fmt.Errorf(pat, args...))
+}
+
+// StdinPipe implements the piper.Executor interface.
+func (e *exe) StdinPipe() (io.WriteCloser, error) {
+	e.piped["stdin"] = true
+	return e.stdinw, nil
+}
+
+// StdoutPipe implements the piper.Executor interface.
+func (e *exe) StdoutPipe() (io.ReadCloser, error) {
+	e.piped["stdout"] = true
+	return e.stdoutr, nil
+}
+
+// StderrPipe implements the piper.Executor interface.
+func (e *exe) StderrPipe() (io.ReadCloser, error) {
+	e.piped["stderr"] = true
+	return e.stderrr, nil
+}
+
+// Start implements the piper.Executor interface by playing back the
+// recorded output and consuming stdin.
+func (e *exe) Start() error {
+	e.started = true
+	var wg sync.WaitGroup
+	wg.Add(3)
+	start := time.Now()
+	play := func(w *io.PipeWriter, chunks []Chunk, piped bool) {
+		defer wg.Done()
+		defer w.Close()
+		if !piped {
+			return
+		}
+		for _, c := range chunks {
+			if e.l.Realtime {
+				select {
+				case <-time.After(c.Offset - time.Since(start)):
+				case <-e.killed:
+					return
+				}
+			}
+			if _, err := w.Write(c.Data); err != nil {
+				return
+			}
+		}
+	}
+	go play(e.stdoutw, e.cmd.Stdout, e.piped["stdout"])
+	go play(e.stderrw, e.cmd.Stderr, e.piped["stderr"])
+	go func() {
+		defer wg.Done()
+		if !e.piped["stdin"] {
+			return
+		}
+		if e.cmd.Stdin != nil {
+			io.Copy(&e.stdin, e.stdinr)
+		} else {
+			io.Copy(ioutil.Discard, e.stdinr)
+		}
+	}()
+	go func() {
+		wg.Wait()
+		if e.l.Realtime {
+			select {
+			case <-time.After(e.cmd.Duration - time.Since(start)):
+			case <-e.killed:
+			}
+		}
+		close(e.done)
+	}()
+	return nil
+}
+
+// Wait implements the piper.Executor interface by returning the recorded
+// outcome, or an error if the command was killed or fed unexpected stdin.
+func (e *exe) Wait() error {
+	if !e.started {
+		return e.Errorf("not started")
+	}
+	<-e.done
+	select {
+	case <-e.killed:
+		return ExitError{Status: -1, Msg: "killed"}
+	default:
+	}
+	if e.cmd.Stdin != nil && e.piped["stdin"] && !bytes.Equal(e.cmd.Stdin, e.stdin.Bytes()) {
+		return e.l.fail(e.Errorf("stdin mismatch: expected %q, got %q", e.cmd.Stdin, e.stdin.Bytes()))
+	}
+	if e.cmd.Error != "" {
+		return ExitError{Status: e.cmd.ExitStatus, Msg: e.cmd.Error}
+	}
+	return nil
+}
+
+// Run implements the piper.Executor interface.
+func (e *exe) Run() error {
+	if err := e.Start(); err != nil {
+		return err
+	}
+	return e.Wait()
+}
+
+// Kill implements the piper.Executor interface by abandoning playback.
+func (e *exe) Kill() error {
+	e.killonce.Do(func() {
+		close(e.killed)
+		e.stdinr.Close()
+		e.stdoutw.Close()
+		e.stderrw.Close()
+	})
+	return nil
+}
@@ -0,0 +1,151 @@
+package replay
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ncabatoff/piper"
+	"github.com/ncabatoff/piper/local"
+)
+
+// Verify implementation of Executor and Launcher interfaces.
+func TestInterfaces(t *testing.T) {
+	_ = piper.Launcher(Launcher{})
+	_ = piper.Executor(&exe{})
+	_ = piper.Launcher(Recorder{})
+	_ = piper.Executor(&recexe{})
+}
+
+type outcome struct {
+	stdout, stderr string
+	status         int
+}
+
+// script runs a fixed sequence of commands via lch.
+func script(lch piper.Launcher) []outcome {
+	var outs []outcome
+	stdout, stderr, err := piper.RunCmdStrInCapture(lch, "cat; echo err >&2", "hello")
+	outs = append(outs, outcome{stdout, stderr, piper.ExitStatus(err)})
+	err = piper.RunCmd(lch, "exit 3")
+	outs = append(outs, outcome{"", "", piper.ExitStatus(err)})
+	pr := piper.Pipe(piper.Launchable{Launcher: lch, Cmd: "echo foo; echo bar >&2"},
+		piper.Launchable{Launcher: lch, Cmd: "tr a-z A-Z"})
+	outs = append(outs, outcome{pr.SnkStdout, pr.SrcStderr, piper.ExitStatus(pr.Err)})
+	return outs
+}
+
+func record(t *testing.T) ([]outcome, Session) {
+	rec := NewRecorder(local.Launcher{}, "script")
+	want := script(rec)
+
+	var buf bytes.Buffer
+	if err := rec.Session().Save(&buf); err != nil {
+		t.Fatalf("error saving session: %v", err)
+	}
+	s, err := Load(&buf)
+	if err != nil {
+		t.Fatalf("error loading session: %v", err)
+	}
+	return want, s
+}
+
+func TestReplay(t *testing.T) {
+	want, s := record(t)
+	if want[0] != (outcome{"hello", "err\n", 0}) || want[1].status != 3 || want[2] != (outcome{"FOO\n", "bar\n", 0}) {
+		t.Fatalf("unexpected results from recording: %+v", want)
+	}
+
+	for _, realtime := range []bool{false, true} {
+		l := NewLauncher(s)
+		l.Realtime = realtime
+		got := script(l)
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("realtime=%v: command %d: expected %+v, got %+v", realtime, i, want[i], got[i])
+			}
+		}
+		if err := l.Done(); err != nil {
+			t.Errorf("realtime=%v: %v", realtime, err)
+		}
+	}
+}
+
+func TestReplayUnexpected(t *testing.T) {
+	_, s := record(t)
+
+	l := NewLauncher(s)
+	if err := piper.RunCmd(l, "exit 3"); err == nil {
+		t.Errorf("unexpected command returned success")
+	}
+	if l.Err() == nil {
+		t.Errorf("unexpected command not reported by Err")
+	}
+
+	l = NewLauncher(s)
+	if _, _, err := piper.RunCmdStrInCapture(l, "cat; echo err >&2", "goodbye"); err == nil {
+		t.Errorf("unexpected stdin returned success")
+	}
+	if err := l.Done(); err == nil {
+		t.Errorf("unexpected stdin and missing commands not reported by Done")
+	}
+}
+
+// TestReplayBinary verifies that stdin and output that aren't valid UTF-8
+// survive saving and loading.
+func TestReplayBinary(t *testing.T) {
+	bin := "\xff\x00\xfe"
+	rec := NewRecorder(local.Launcher{}, "binary")
+	if _, _, err := piper.RunCmdStrInCapture(rec, "cat", bin); err != nil {
+		t.Fatalf("error running cat: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := rec.Session().Save(&buf); err != nil {
+		t.Fatalf("error saving session: %v", err)
+	}
+	s, err := Load(&buf)
+	if err != nil {
+		t.Fatalf("error loading session: %v", err)
+	}
+
+	l := NewLauncher(s)
+	stdout, _, err := piper.RunCmdStrInCapture(l, "cat", bin)
+	if err != nil || stdout != bin {
+		t.Errorf("expected %q, got %q, %v", bin, stdout, err)
+	}
+	if err := l.Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRecordNotWaited verifies that a command killed and never waited for
+// isn't replayed as a success.
+func TestRecordNotWaited(t *testing.T) {
+	rec := NewRecorder(local.Launcher{}, "abandoned")
+	exe, err := rec.Launch("sleep 10")
+	if err != nil {
+		t.Fatalf("error launching: %v", err)
+	}
+	if err := exe.Start(); err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	exe.Kill()
+
+	err = piper.RunCmd(NewLauncher(rec.Session()), "sleep 10")
+	if piper.ExitStatus(err) != -1 {
+		t.Errorf("expected exit status -1, got %v", err)
+	}
+	exe.Wait()
+}
+
+func TestZeroLauncher(t *testing.T) {
+	var l Launcher
+	if l.String() != "replay:" {
+		t.Errorf("unexpected String %q", l.String())
+	}
+	if _, err := l.Launch("true"); err == nil {
+		t.Errorf("expected error launching from zero Launcher")
+	}
+	if l.Err() != nil || l.Done() != nil {
+		t.Errorf("expected no errors from zero Launcher")
+	}
+}
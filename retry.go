@@ -0,0 +1,138 @@
+package piper
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+type (
+	// StartError reports that a command couldn't be launched or started,
+	// so it can't have had any effect and is always safe to retry.
+	StartError struct {
+		Err error
+	}
+
+	// Retry describes how to retry commands that fail transiently.  The
+	// zero value tries just once.
+	Retry struct {
+		// Attempts is the maximum number of tries.
+		Attempts int
+		// Backoff is the delay before the first retry.  It doubles with
+		// each subsequent retry, up to MaxBackoff if that's positive.
+		Backoff    time.Duration
+		MaxBackoff time.Duration
+		// Jitter randomizes each delay by up to this fraction of it in
+		// either direction, e.g. 0.2 for +/-20%.
+		Jitter float64
+		// Transient, if non-nil, classifies errors other than StartErrors
+		// as worth retrying, e.g. ssh.IsConnectionLost.  Such an error is
+		// retried only if no data had been transferred, unless Idempotent.
+		Transient func(error) bool
+		// Idempotent means the command may be rerun even after it has
+		// done some work, i.e. it's harmless to run it more than once.
+		Idempotent bool
+	}
+)
+
+// Error implements error.
+func (e *StartError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+// IsStartError returns true if err is or wraps a StartError.
+func IsStartError(err error) bool {
+	var se *StartError
+	return errors.As(err, &se)
+}
+
+// retryable returns true if a try that failed with err should be retried.
+// progressed says whether the command has transferred any data.
+func (r Retry) retryable(err error, progressed bool) bool {
+	if err == nil {
+		return false
+	}
+	if IsStartError(err) {
+		return true
+	}
+	if r.Transient == nil || !r.Transient(err) {
+		return false
+	}
+	return r.Idempotent || !progressed
+}
+
+// do calls try until it returns false or we run out of attempts, sleeping
+// in between.  try returns true if it failed in a way worth retrying.
+func (r Retry) do(try func() bool) {
+	delay := r.Backoff
+	for i := 1; try() && i < r.Attempts; i++ {
+		d := delay
+		if r.Jitter > 0 {
+			d += time.Duration((rand.Float64()*2 - 1) * r.Jitter * float64(d))
+		}
+		time.Sleep(d)
+		delay *= 2
+		if r.MaxBackoff > 0 && delay > r.MaxBackoff {
+			delay = r.MaxBackoff
+		}
+	}
+}
+
+// RunCmd is like the package-level RunCmd, but retries per r.
+func (r Retry) RunCmd(lch Launcher, cmd string) error {
+	return r.RunCmdWith(lch, cmd, RunOptions{}).Err
+}
+
+// RunCmdCapture is like the package-level RunCmdCapture, but retries per r.
+func (r Retry) RunCmdCapture(lch Launcher, cmd string) (stdout string, stderr string, err error) {
+	rr := r.RunCmdWith(lch, cmd, RunOptions{Capture: true})
+	return rr.Stdout, rr.Stderr, rr.Err
+}
+
+// RunCmdWith is like the package-level RunCmdWith, but retries per r.
+// Without captured output we can't tell whether the command has done any
+// work, so unless r is Idempotent only StartErrors are retried.  The same
+// goes, even if r is Idempotent, when opts has a StdinReader or Stdout.
+func (r Retry) RunCmdWith(lch Launcher, cmd string, opts RunOptions) RunResult {
+	var rr RunResult
+	r.do(func() bool {
+		rr = RunCmdWith(lch, cmd, opts)
+		if opts.StdinReader != nil || opts.Stdout != nil {
+			// The input can't be replayed, nor the output taken back.
+			return IsStartError(rr.Err)
+		}
+		progressed := !opts.Capture || rr.Stdout != "" || rr.Stderr != "" ||
+			opts.Stdin != nil && *opts.Stdin != ""
+		return r.retryable(rr.Err, progressed)
+	})
+	return rr
+}
+
+// Pipe is like the package-level Pipe, but retries per r.
+func (r Retry) Pipe(srclch, snklch Launchable) PipeResult {
+	return r.PipeWith(srclch, snklch, PipeOptions{})
+}
+
+// PipeWith is like the package-level PipeWith, but retries per r.  Unless r
+// is Idempotent the data is relayed, as for PipeOptions.Relay, since with an
+// OS pipe or a Direct transfer we couldn't tell whether any data moved.
+func (r Retry) PipeWith(srclch, snklch Launchable, opts PipeOptions) PipeResult {
+	if !r.Idempotent {
+		opts.Relay = true
+	}
+	var pr PipeResult
+	r.do(func() bool {
+		pr = PipeWith(srclch, snklch, opts)
+		if opts.Stdout != nil && pr.SnkStdout != "" {
+			// Output already passed on can't be taken back.
+			return false
+		}
+		return r.retryable(pr.Err, pr.Bytes > 0 || pr.SnkStdout != "")
+	})
+	return pr
+}
@@ -0,0 +1,231 @@
+package piper
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Rewriter wraps an existing launcher, rewriting each command before
+	// launching it with the embedded Launcher, e.g. to run it in some other
+	// environment on the same host.  Executors it returns describe and
+	// report the command as given rather than as rewritten.
+	Rewriter struct {
+		Launcher
+		// Name describes the environment, for String.
+		Name string
+		// Rewrite returns cmd as it should be launched.
+		Rewrite func(cmd string) (string, error)
+	}
+
+	// Chroot wraps an existing launcher to run its commands in a chroot
+	// via chroot(8).  Dir is the new root, as seen by the embedded
+	// Launcher's host.
+	Chroot struct {
+		Launcher
+		Dir string
+	}
+
+	// Nsenter wraps an existing launcher to run its commands in the
+	// namespaces of an existing process via nsenter(1), e.g. that of a
+	// container's init process.
+	Nsenter struct {
+		Launcher
+		// PID is the process whose namespaces are entered.
+		PID int
+		// Namespaces names those to enter, as in nsenter's long options:
+		// "mount", "uts", "ipc", "net", "pid", "cgroup" or "user".  The
+		// default is mount, uts, ipc, net and pid.
+		Namespaces []string
+	}
+
+	// ContainerExec wraps an existing launcher to run its commands in a
+	// running container via "RUNTIME exec -i CONTAINER", which suits
+	// docker, podman and nerdctl, among others.  Note that killing a
+	// command kills the exec client, which needn't stop the command in the
+	// container.
+	ContainerExec struct {
+		Launcher
+		// Runtime is the container CLI; the default is docker.
+		Runtime string
+		// Container is the name or ID of the container.
+		Container string
+		// User, if set, is who to run commands as in the container.
+		User string
+		// Args are extra arguments to exec, e.g. "-w", "/data".
+		Args []string
+	}
+
+	// rewriteexe runs a rewritten command.
+	rewriteexe struct {
+		Executor
+		l       Rewriter
+		command string
+	}
+
+	// rewritefileexe is a rewriteexe whose underlying Executor is a
+	// FileExecutor.
+	rewritefileexe struct {
+		*rewriteexe
+		fe FileExecutor
+	}
+)
+
+// defaultNamespaces are those Nsenter enters by default.
+var defaultNamespaces = []string{"mount", "uts", "ipc", "net", "pid"}
+
+// String implements the Launcher interface.
+func (l Rewriter) String() string {
+	return fmt.Sprintf("%s+%s", l.Launcher, l.Name)
+}
+
+// Errorf implements the Launcher interface.
+func (l Rewriter) Errorf(pat string, args ...interface{}) error {
+	pfx := fmt.Sprintf("%s: ", l)
+	return fmt.Errorf("%s: %w", pfx, fmt.Errorf(pat, args...))
+}
+
+// Launch implements the Launcher interface.
+func (l Rewriter) Launch(cmd string) (Executor, error) {
+	wrapped, err := l.Rewrite(cmd)
+	if err != nil {
+		return nil, l.Errorf("error rewriting command %q: %w", cmd, err)
+	}
+	exe, err := l.Launcher.Launch(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	e := &rewriteexe{Executor: exe, l: l, command: cmd}
+	if fe, ok := exe.(FileExecutor); ok {
+		return rewritefileexe{e, fe}, nil
+	}
+	return e, nil
+}
+
+// Errorf implements the Executor interface.
+func (e *rewriteexe) Errorf(pat string, args ...interface{}) error {
+	pfx := fmt.Sprintf("cmd %s{%s} :", e.l, e.command)
+	return fmt.Errorf("%s: %w", pfx, fmt.Errorf(pat, args...))
+}
+
+// Command implements the Executor interface by returning the command as
+// given, not as rewritten.
+func (e *rewriteexe) Command() string {
+	return e.command
+}
+
+// SetStdin implements the FileExecutor interface.
+func (e rewritefileexe) SetStdin(f *os.File) {
+	e.fe.SetStdin(f)
+}
+
+// SetStdout implements the FileExecutor interface.
+func (e rewritefileexe) SetStdout(f *os.File) {
+	e.fe.SetStdout(f)
+}
+
+// rewriter returns the Rewriter for l.
+func (l Chroot) rewriter() Rewriter {
+	return Rewriter{Launcher: l.Launcher, Name: "chroot:" + l.Dir, Rewrite: func(cmd string) (string, error) {
+		if l.Dir == "" {
+			return "", fmt.Errorf("no chroot directory given")
+		}
+		return "chroot " + ShellQuote(l.Dir) + " sh -c " + ShellQuote(cmd), nil
+	}}
+}
+
+// String implements the Launcher interface.
+func (l Chroot) String() string {
+	return l.rewriter().String()
+}
+
+// Errorf implements the Launcher interface.
+func (l Chroot) Errorf(pat string, args ...interface{}) error {
+	return l.rewriter().Errorf(pat, args...)
+}
+
+// Launch implements the Launcher interface.
+func (l Chroot) Launch(cmd string) (Executor, error) {
+	return l.rewriter().Launch(cmd)
+}
+
+// rewriter returns the Rewriter for l.
+func (l Nsenter) rewriter() Rewriter {
+	return Rewriter{Launcher: l.Launcher, Name: "nsenter:" + strconv.Itoa(l.PID), Rewrite: func(cmd string) (string, error) {
+		if l.PID <= 0 {
+			return "", fmt.Errorf("invalid pid %d", l.PID)
+		}
+		nss := l.Namespaces
+		if len(nss) == 0 {
+			nss = defaultNamespaces
+		}
+		args := []string{"nsenter", "-t", strconv.Itoa(l.PID)}
+		for _, ns := range nss {
+			switch ns {
+			case "mount", "uts", "ipc", "net", "pid", "cgroup", "user":
+				args = append(args, "--"+ns)
+			default:
+				return "", fmt.Errorf("unknown namespace %q", ns)
+			}
+		}
+		return strings.Join(args, " ") + " sh -c " + ShellQuote(cmd), nil
+	}}
+}
+
+// String implements the Launcher interface.
+func (l Nsenter) String() string {
+	return l.rewriter().String()
+}
+
+// Errorf implements the Launcher interface.
+func (l Nsenter) Errorf(pat string, args ...interface{}) error {
+	return l.rewriter().Errorf(pat, args...)
+}
+
+// Launch implements the Launcher interface.
+func (l Nsenter) Launch(cmd string) (Executor, error) {
+	return l.rewriter().Launch(cmd)
+}
+
+// runtime returns the container CLI.
+func (l ContainerExec) runtime() string {
+	if l.Runtime == "" {
+		return "docker"
+	}
+	return l.Runtime
+}
+
+// rewriter returns the Rewriter for l.
+func (l ContainerExec) rewriter() Rewriter {
+	return Rewriter{Launcher: l.Launcher, Name: l.runtime() + ":" + l.Container, Rewrite: func(cmd string) (string, error) {
+		if l.Container == "" {
+			return "", fmt.Errorf("no container given")
+		}
+		args := []string{ShellQuote(l.runtime()), "exec", "-i"}
+		if l.User != "" {
+			args = append(args, "-u", ShellQuote(l.User))
+		}
+		for _, a := range l.Args {
+			args = append(args, ShellQuote(a))
+		}
+		args = append(args, ShellQuote(l.Container), "sh", "-c", ShellQuote(cmd))
+		return strings.Join(args, " "), nil
+	}}
+}
+
+// String implements the Launcher interface.
+func (l ContainerExec) String() string {
+	return l.rewriter().String()
+}
+
+// Errorf implements the Launcher interface.
+func (l ContainerExec) Errorf(pat string, args ...interface{}) error {
+	return l.rewriter().Errorf(pat, args...)
+}
+
+// Launch implements the Launcher interface.
+func (l ContainerExec) Launch(cmd string) (Executor, error) {
+	return l.rewriter().Launch(cmd)
+}
@@ -0,0 +1,200 @@
+package piper
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// defaultMaxRecord is the default bound on the size of a record.
+const defaultMaxRecord = 1 << 20
+
+type (
+	// ScanOptions modifies how ScanCmd splits a command's output.  The
+	// zero value gives newline-terminated lines.
+	ScanOptions struct {
+		// Delim ends each record, e.g. "\x00" for the output of
+		// find -print0.  The default is "\n".
+		Delim string
+		// MaxRecord bounds the size of a record, by default 1MiB.  A
+		// longer record stops the scan with an error.
+		MaxRecord int
+		// Stdin, if non-nil, is written to the command's standard input.
+		Stdin *string
+		// CaptureLimit, if positive, bounds what's kept of stderr to its
+		// first and last CaptureLimit bytes.
+		CaptureLimit int
+	}
+
+	// Scanner iterates over the records a running command writes to its
+	// stdout, as they arrive.  As with bufio.Scanner, call Next until it
+	// returns false and then check Err.  Call Close when done, which kills
+	// the command if it's still running.
+	Scanner struct {
+		exe    Executor
+		stdout io.ReadCloser
+		sc     *bufio.Scanner
+		stderr *capture
+		// errchan yields the errors from copying stderr and stdin, once
+		// they're done.
+		errchan chan error
+		nerrs   int
+		done    bool
+		err     error
+	}
+)
+
+// ScanCmd starts cmd using lch and returns a Scanner over its stdout.
+// An error is returned only if the command couldn't be started.
+func ScanCmd(lch Launcher, cmd string, opts ScanOptions) (*Scanner, error) {
+	exe, err := lch.Launch(cmd)
+	if err != nil {
+		return nil, &StartError{lch.Errorf("error starting %s: %w", cmd, err)}
+	}
+	s := &Scanner{exe: exe, stderr: newCapture(opts.CaptureLimit), errchan: make(chan error, 2)}
+
+	var stderr io.ReadCloser
+	var stdin io.WriteCloser
+	// fail closes whatever pipes are open, releases exe and returns err.
+	fail := func(err error) (*Scanner, error) {
+		for _, c := range []io.Closer{s.stdout, stderr, stdin} {
+			if c != nil {
+				c.Close()
+			}
+		}
+		release(exe)
+		return nil, &StartError{err}
+	}
+	if s.stdout, err = exe.StdoutPipe(); err != nil {
+		return fail(exe.Errorf("error opening stdout pipe: %w", err))
+	}
+	if stderr, err = exe.StderrPipe(); err != nil {
+		return fail(exe.Errorf("error opening stderr pipe: %w", err))
+	}
+	if opts.Stdin != nil {
+		if stdin, err = exe.StdinPipe(); err != nil {
+			return fail(exe.Errorf("error opening stdin pipe: %w", err))
+		}
+	}
+	if err := exe.Start(); err != nil {
+		return fail(exe.Errorf("error starting: %w", err))
+	}
+
+	go copyClose(s.stderr, stderr, s.errchan)
+	s.nerrs++
+	if stdin != nil {
+		go func() {
+			copyClose(stdin, bytes.NewBufferString(*opts.Stdin), s.errchan)
+			stdin.Close()
+		}()
+		s.nerrs++
+	}
+
+	delim := opts.Delim
+	if delim == "" {
+		delim = "\n"
+	}
+	max := opts.MaxRecord
+	if max <= 0 {
+		max = defaultMaxRecord
+	}
+	s.sc = bufio.NewScanner(s.stdout)
+	s.sc.Buffer(nil, max)
+	s.sc.Split(splitDelim(delim))
+	return s, nil
+}
+
+// splitDelim returns a bufio.SplitFunc yielding records ending in delim,
+// without it.  A final record needn't be terminated.
+func splitDelim(delim string) bufio.SplitFunc {
+	d := []byte(delim)
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, d); i >= 0 {
+			return i + len(d), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// Next advances to the next record, returning false once there are no
+// more, either because the command's output is exhausted or because
+// something went wrong; Err says which.  Once Next returns false the
+// command has exited.
+func (s *Scanner) Next() bool {
+	if s.done {
+		return false
+	}
+	if s.sc.Scan() {
+		return true
+	}
+	s.finish(s.sc.Err())
+	return false
+}
+
+// Text returns the current record as a string.
+func (s *Scanner) Text() string {
+	return s.sc.Text()
+}
+
+// Bytes returns the current record.  It may be overwritten by the next
+// call to Next.
+func (s *Scanner) Bytes() []byte {
+	return s.sc.Bytes()
+}
+
+// Stderr returns what the command has written to stderr.  It's complete
+// only once Next has returned false or Close has been called.
+func (s *Scanner) Stderr() string {
+	if !s.done {
+		return ""
+	}
+	return s.stderr.String()
+}
+
+// Err returns the error, if any, from reading the command's output or from
+// the command exiting.  It's nil until Next has returned false.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Close releases the command, killing it first if its output hasn't been
+// exhausted, and returns Err.  An abandoned command being killed isn't
+// considered an error.
+func (s *Scanner) Close() error {
+	if !s.done {
+		s.exe.Kill()
+		s.finish(nil)
+		s.err = nil
+	}
+	return s.err
+}
+
+// finish waits for the command to exit, given the error from scanning its
+// stdout.
+func (s *Scanner) finish(scanerr error) {
+	s.done = true
+	if scanerr != nil {
+		s.exe.Kill()
+	}
+	// Drain stdout so the command isn't blocked writing it.
+	io.Copy(ioutil.Discard, s.stdout)
+	var errs []error
+	for ; s.nerrs > 0; s.nerrs-- {
+		if err := <-s.errchan; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err := s.exe.Wait()
+	switch {
+	case scanerr != nil:
+		s.err = s.exe.Errorf("error reading output: %w", scanerr)
+	case err != nil:
+		s.err = s.exe.Errorf("completed with error: %w", err)
+	default:
+		s.err = joinerrs("; ", errs...)
+	}
+}
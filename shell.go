@@ -0,0 +1,24 @@
+package piper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ShellQuote quotes s so that a POSIX shell will treat it as a single word
+// with no expansions.
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellPipeline returns a POSIX sh script that runs a | b.  Unlike a plain
+// pipe, whose status is that of b alone, the script exits with the first
+// non-zero status of the two commands, so that a failing producer isn't
+// masked by a consumer that happily accepted its truncated output.  We can't
+// rely on "set -o pipefail" since dash and other minimal shells lack it.
+func shellPipeline(a, b string) string {
+	return fmt.Sprintf(`{ piper_rc=$( { { (%s
+) 3>&- 4>&-; echo $? >&3; } | { (%s
+) 3>&- >&4 4>&-; echo $? >&3; }; } 3>&1 ); } 4>&1
+for piper_c in $piper_rc; do [ "$piper_c" -eq 0 ] || exit "$piper_c"; done`, a, b)
+}
@@ -0,0 +1,346 @@
+// Package spec runs pipelines described declaratively in JSON, so that
+// transfers can be configured rather than coded.  A spec names some hosts
+// and lists the stages to run on them:
+//
+//	{
+//	  "hosts": {
+//	    "db":   {"type": "ssh", "host": "db1.example.com", "user": "backup"},
+//	    "here": {"type": "local"}
+//	  },
+//	  "stages": [
+//	    {"host": "db", "cmd": "pg_dump mydb"},
+//	    {"host": "here", "cmd": "gzip -c > mydb.sql.gz"}
+//	  ]
+//	}
+//
+// ssh hosts' keys are checked against ~/.ssh/known_hosts, or the file given
+// as "known_hosts", unless "insecure_ignore_host_key" is true.
+//
+// One stage is run with piper.RunCmdWith, two with piper.PipeWith, and more
+// with piper.Pipeline.  Run returns a Report which serializes to JSON.
+package spec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ncabatoff/piper"
+	"github.com/ncabatoff/piper/local"
+	"github.com/ncabatoff/piper/ssh"
+	xssh "golang.org/x/crypto/ssh"
+)
+
+// Host types.
+const (
+	TypeLocal = "local"
+	TypeSSH   = "ssh"
+)
+
+type (
+	// Spec describes a pipeline.
+	Spec struct {
+		// Hosts maps names used by Stages to host descriptions.
+		Hosts map[string]Host `json:"hosts"`
+		// Stages are the commands to run, each feeding its stdout to the
+		// next one's stdin.
+		Stages []Stage `json:"stages"`
+		// CaptureLimit, if positive, bounds what's kept of each captured
+		// stream to its first and last CaptureLimit bytes.
+		CaptureLimit int `json:"capture_limit,omitempty"`
+	}
+
+	// Host describes where commands run.
+	Host struct {
+		// Type is TypeLocal or TypeSSH.
+		Type string `json:"type"`
+		// Address is the ssh host to connect to.
+		Address string `json:"host,omitempty"`
+		// Port is the ssh port, by default 22.
+		Port int `json:"port,omitempty"`
+		// User is the ssh user, by default the current user.
+		User string `json:"user,omitempty"`
+		// Key is the path of the ssh private key, by default
+		// ~/.ssh/id_rsa.
+		Key string `json:"key,omitempty"`
+		// KnownHosts is the path of the file listing ssh host keys, by
+		// default ~/.ssh/known_hosts.  Hosts whose keys it doesn't list
+		// are refused.
+		KnownHosts string `json:"known_hosts,omitempty"`
+		// InsecureIgnoreHostKey skips checking the ssh host key, leaving
+		// the connection open to interception.
+		InsecureIgnoreHostKey bool `json:"insecure_ignore_host_key,omitempty"`
+	}
+
+	// Stage is a command to run on a host.
+	Stage struct {
+		// Host is a key of Spec.Hosts.
+		Host string `json:"host"`
+		Cmd  string `json:"cmd"`
+	}
+
+	// Report describes the outcome of running a Spec.
+	Report struct {
+		OK       bool          `json:"ok"`
+		Error    string        `json:"error,omitempty"`
+		Start    time.Time     `json:"start"`
+		Duration time.Duration `json:"duration"`
+		Stages   []StageReport `json:"stages"`
+		// Stdout is what the last stage wrote to its stdout.
+		Stdout string `json:"stdout"`
+	}
+
+	// StageReport describes the outcome of one stage.
+	StageReport struct {
+		Host   string `json:"host"`
+		Cmd    string `json:"cmd"`
+		Stderr string `json:"stderr"`
+		// Error is set if the stage's command failed.
+		Error string `json:"error,omitempty"`
+		// ExitStatus is as returned by piper.ExitStatus, or 0 on success.
+		ExitStatus int `json:"exit_status"`
+		// Bytes is as in piper.StageResult.
+		Bytes int64 `json:"bytes"`
+	}
+)
+
+// Load reads a Spec from JSON and validates it.  Unknown fields are errors,
+// so that typos don't go unnoticed.
+func Load(r io.Reader) (Spec, error) {
+	var s Spec
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return Spec{}, fmt.Errorf("error loading spec: %v", err)
+	}
+	if err := s.Validate(); err != nil {
+		return Spec{}, err
+	}
+	return s, nil
+}
+
+// Validate returns an error describing everything wrong with s, or nil.
+func (s Spec) Validate() error {
+	var probs []string
+	names := make([]string, 0, len(s.Hosts))
+	for name := range s.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, p := range s.Hosts[name].problems() {
+			probs = append(probs, fmt.Sprintf("host %q: %s", name, p))
+		}
+	}
+	if len(s.Stages) == 0 {
+		probs = append(probs, "no stages")
+	}
+	for i, st := range s.Stages {
+		if _, ok := s.Hosts[st.Host]; !ok {
+			probs = append(probs, fmt.Sprintf("stage %d: unknown host %q", i, st.Host))
+		}
+		if st.Cmd == "" {
+			probs = append(probs, fmt.Sprintf("stage %d: no command", i))
+		}
+	}
+	if len(probs) > 0 {
+		return fmt.Errorf("invalid spec: %v", probs)
+	}
+	return nil
+}
+
+// Validate returns an error describing everything wrong with h, or nil.
+func (h Host) Validate() error {
+	if probs := h.problems(); len(probs) > 0 {
+		return fmt.Errorf("invalid host: %v", probs)
+	}
+	return nil
+}
+
+// problems returns descriptions of everything wrong with h.
+func (h Host) problems() []string {
+	var probs []string
+	switch h.Type {
+	case TypeLocal:
+		if h.Address != "" || h.Port != 0 || h.User != "" || h.Key != "" ||
+			h.KnownHosts != "" || h.InsecureIgnoreHostKey {
+			probs = append(probs, "local hosts take no ssh settings")
+		}
+	case TypeSSH:
+		if h.Address == "" {
+			probs = append(probs, "no address")
+		}
+		if h.Port < 0 || h.Port > 65535 {
+			probs = append(probs, fmt.Sprintf("invalid port %d", h.Port))
+		}
+		if h.KnownHosts != "" && h.InsecureIgnoreHostKey {
+			probs = append(probs, "known_hosts given but host key ignored")
+		}
+	default:
+		probs = append(probs, fmt.Sprintf("unknown type %q", h.Type))
+	}
+	return probs
+}
+
+// Launcher creates a Launcher for h.
+func (h Host) Launcher() (piper.Launcher, error) {
+	switch h.Type {
+	case TypeLocal:
+		return local.Launcher{}, nil
+	case TypeSSH:
+		var err error
+		key := h.Key
+		if key == "" {
+			if key, err = sshFile("id_rsa"); err != nil {
+				return nil, fmt.Errorf("can't determine ssh key: %v", err)
+			}
+		}
+		var hostKey xssh.HostKeyCallback
+		if !h.InsecureIgnoreHostKey {
+			known := h.KnownHosts
+			if known == "" {
+				if known, err = sshFile("known_hosts"); err != nil {
+					return nil, fmt.Errorf("can't determine known hosts: %v", err)
+				}
+			}
+			if hostKey, err = ssh.KnownHosts(known); err != nil {
+				return nil, err
+			}
+		}
+		target := h.Address
+		if h.Port != 0 {
+			target = net.JoinHostPort(h.Address, strconv.Itoa(h.Port))
+		}
+		if h.User != "" {
+			target = h.User + "@" + target
+		}
+		lch, err := ssh.DialWith(target, key, hostKey)
+		if err != nil {
+			return nil, err
+		}
+		return lch, nil
+	}
+	return nil, fmt.Errorf("unknown host type %q", h.Type)
+}
+
+// sshFile returns the path of ~/.ssh/name.
+func sshFile(name string) (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".ssh", name), nil
+}
+
+// Launchers creates a Launcher for each host used by a stage.  On error,
+// any already created are closed.
+func (s Spec) Launchers() (map[string]piper.Launcher, error) {
+	lchs := make(map[string]piper.Launcher)
+	for _, st := range s.Stages {
+		if _, ok := lchs[st.Host]; ok {
+			continue
+		}
+		h, ok := s.Hosts[st.Host]
+		if !ok {
+			closeAll(lchs)
+			return nil, fmt.Errorf("unknown host %q", st.Host)
+		}
+		lch, err := h.Launcher()
+		if err != nil {
+			closeAll(lchs)
+			return nil, fmt.Errorf("host %q: %w", st.Host, err)
+		}
+		lchs[st.Host] = lch
+	}
+	return lchs, nil
+}
+
+// closeAll closes lchs.
+func closeAll(lchs map[string]piper.Launcher) {
+	for _, lch := range lchs {
+		lch.Close()
+	}
+}
+
+// Launchables returns the stages of s bound to the launchers in lchs, as
+// returned by Launchers.
+func (s Spec) Launchables(lchs map[string]piper.Launcher) []piper.Launchable {
+	ls := make([]piper.Launchable, len(s.Stages))
+	for i, st := range s.Stages {
+		ls[i] = piper.Launchable{Launcher: lchs[st.Host], Cmd: st.Cmd}
+	}
+	return ls
+}
+
+// Run validates s, connects to its hosts, and runs its stages.  Failures
+// of any kind are described by the Report rather than returned.
+func (s Spec) Run() (rep Report) {
+	rep = Report{Start: time.Now(), Stages: make([]StageReport, len(s.Stages))}
+	for i, st := range s.Stages {
+		rep.Stages[i] = StageReport{Host: st.Host, Cmd: st.Cmd}
+	}
+	defer func() {
+		rep.Duration = time.Since(rep.Start)
+	}()
+
+	if err := s.Validate(); err != nil {
+		rep.Error = err.Error()
+		return rep
+	}
+	lchs, err := s.Launchers()
+	if err != nil {
+		rep.Error = err.Error()
+		return rep
+	}
+	defer closeAll(lchs)
+
+	stages := s.Launchables(lchs)
+	var errs []error
+	switch len(stages) {
+	case 1:
+		rr := piper.RunCmdWith(stages[0].Launcher, stages[0].Cmd,
+			piper.RunOptions{Capture: true, CaptureLimit: s.CaptureLimit})
+		rep.Stdout, rep.Stages[0].Stderr = rr.Stdout, rr.Stderr
+		errs = []error{rr.Err, rr.Err}
+	case 2:
+		pr := piper.PipeWith(stages[0], stages[1], piper.PipeOptions{CaptureLimit: s.CaptureLimit})
+		rep.Stdout, rep.Stages[0].Stderr, rep.Stages[1].Stderr = pr.SnkStdout, pr.SrcStderr, pr.SnkStderr
+		rep.Stages[0].Bytes = pr.Bytes
+		errs = []error{pr.Err, pr.SrcErr, pr.SnkErr}
+	default:
+		pr := piper.Pipeline(stages, piper.PipelineOptions{CaptureLimit: s.CaptureLimit})
+		rep.Stdout = pr.Stdout
+		errs = []error{pr.Err}
+		for i, sr := range pr.Stages {
+			rep.Stages[i].Stderr, rep.Stages[i].Bytes = sr.Stderr, sr.Bytes
+			errs = append(errs, sr.Err)
+		}
+	}
+
+	if errs[0] != nil {
+		rep.Error = errs[0].Error()
+	}
+	for i, err := range errs[1:] {
+		if err != nil {
+			rep.Stages[i].Error, rep.Stages[i].ExitStatus = err.Error(), piper.ExitStatus(err)
+		}
+	}
+	rep.OK = rep.Error == ""
+	return rep
+}
+
+// Save writes r as JSON.
+func (r Report) Save(w io.Writer) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
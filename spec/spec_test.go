@@ -0,0 +1,148 @@
+package spec
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ncabatoff/piper/test"
+	"golang.org/x/crypto/ssh"
+)
+
+func load(t *testing.T, js string) Spec {
+	s, err := Load(strings.NewReader(js))
+	if err != nil {
+		t.Fatalf("error loading spec: %v", err)
+	}
+	return s
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		js, want string
+	}{
+		{`{"hosts": {}, "stages": []}`, "no stages"},
+		{`{"hosts": {"h": {"type": "local"}}, "stages": [{"host": "x", "cmd": "true"}]}`, `unknown host "x"`},
+		{`{"hosts": {"h": {"type": "local"}}, "stages": [{"host": "h"}]}`, "no command"},
+		{`{"hosts": {"h": {"type": "ftp"}}, "stages": [{"host": "h", "cmd": "true"}]}`, `unknown type "ftp"`},
+		{`{"hosts": {"h": {"type": "ssh"}}, "stages": [{"host": "h", "cmd": "true"}]}`, "no address"},
+		{`{"hosts": {"h": {"type": "ssh", "host": "x", "port": 70000}}, "stages": [{"host": "h", "cmd": "true"}]}`, "invalid port"},
+		{`{"hosts": {"h": {"type": "local", "user": "bob"}}, "stages": [{"host": "h", "cmd": "true"}]}`, "no ssh settings"},
+		{`{"hosts": {"h": {"type": "local", "insecure_ignore_host_key": true}}, "stages": [{"host": "h", "cmd": "true"}]}`, "no ssh settings"},
+		{`{"hosts": {"h": {"type": "ssh", "host": "x", "known_hosts": "/k", "insecure_ignore_host_key": true}}, "stages": [{"host": "h", "cmd": "true"}]}`, "host key ignored"},
+		{`{"hosts": {}, "stages": [], "extra": 1}`, "unknown field"},
+		{`{"hosts": `, "error loading spec"},
+	} {
+		_, err := Load(strings.NewReader(tc.js))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("loading %s: expected error containing %q, got %v", tc.js, tc.want, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	hosts := `"hosts": {"a": {"type": "local"}, "b": {"type": "local"}}`
+	for _, tc := range []struct {
+		stages, stdout string
+	}{
+		{`[{"host": "a", "cmd": "echo hello; echo e0 >&2"}]`, "hello\n"},
+		{`[{"host": "a", "cmd": "echo hello; echo e0 >&2"}, {"host": "b", "cmd": "tr a-z A-Z; echo e1 >&2"}]`, "HELLO\n"},
+		{`[{"host": "a", "cmd": "echo hello; echo e0 >&2"}, {"host": "b", "cmd": "tr a-z A-Z; echo e1 >&2"},
+			{"host": "a", "cmd": "rev; echo e2 >&2"}]`, "OLLEH\n"},
+	} {
+		rep := load(t, `{`+hosts+`, "stages": `+tc.stages+`}`).Run()
+		if !rep.OK || rep.Error != "" {
+			t.Errorf("%s: expected success, got %q", tc.stages, rep.Error)
+		}
+		if rep.Stdout != tc.stdout {
+			t.Errorf("%s: expected stdout %q, got %q", tc.stages, tc.stdout, rep.Stdout)
+		}
+		for i, sr := range rep.Stages {
+			if want := "e" + string(rune('0'+i)) + "\n"; sr.Stderr != want || sr.Error != "" {
+				t.Errorf("%s: stage %d: expected stderr %q, got %q, %q", tc.stages, i, want, sr.Stderr, sr.Error)
+			}
+		}
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	rep := load(t, `{"hosts": {"a": {"type": "local"}},
+		"stages": [{"host": "a", "cmd": "echo hi"}, {"host": "a", "cmd": "cat; exit 3"}]}`).Run()
+	if rep.OK || rep.Error == "" {
+		t.Errorf("expected failure, got %+v", rep)
+	}
+	// The source may or may not have been killed before it exited.
+	if rep.Stages[1].Error == "" || rep.Stages[1].ExitStatus != 3 {
+		t.Errorf("expected sink to fail with status 3, got %+v", rep.Stages[1])
+	}
+
+	var buf bytes.Buffer
+	if err := rep.Save(&buf); err != nil {
+		t.Fatalf("error saving report: %v", err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("error decoding report: %v", err)
+	}
+	if m["ok"] != false || m["stdout"] != "hi\n" {
+		t.Errorf("unexpected report %s", buf.String())
+	}
+}
+
+func TestRunConnectFailure(t *testing.T) {
+	rep := load(t, `{"hosts": {"a": {"type": "local"}, "b": {"type": "ssh", "host": "127.0.0.1", "port": 1, "key": "/nonexistent"}},
+		"stages": [{"host": "a", "cmd": "echo hi"}, {"host": "b", "cmd": "cat"}]}`).Run()
+	if rep.OK || !strings.Contains(rep.Error, `host "b"`) {
+		t.Errorf("expected failure connecting to host b, got %q", rep.Error)
+	}
+}
+
+func TestHostKey(t *testing.T) {
+	addr, hostKey := test.SSHServer(t)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "id")
+	test.WriteSSHKey(t, key)
+	known := filepath.Join(dir, "known_hosts")
+	listed := filepath.Join(dir, "listed")
+	if err := ioutil.WriteFile(known, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	entry := "[" + host + "]:" + port + " " + string(ssh.MarshalAuthorizedKey(hostKey))
+	if err := ioutil.WriteFile(listed, []byte(entry), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Host{Type: TypeSSH, Address: host, User: "nobody", Key: key, KnownHosts: known}
+	if h.Port, err = strconv.Atoi(port); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Launcher(); err == nil || !strings.Contains(err.Error(), "no host key known") {
+		t.Errorf("unlisted host key: expected a host key error, got %v", err)
+	}
+	h.KnownHosts = listed
+	if lch, err := h.Launcher(); err != nil {
+		t.Errorf("listed host key: %v", err)
+	} else {
+		lch.Close()
+	}
+	h.KnownHosts, h.InsecureIgnoreHostKey = "", true
+	if lch, err := h.Launcher(); err != nil {
+		t.Errorf("ignored host key: %v", err)
+	} else {
+		lch.Close()
+	}
+}
@@ -0,0 +1,151 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// knownHost is one entry of a known_hosts file.
+type knownHost struct {
+	revoked bool
+	// patterns are the host patterns the entry applies to.
+	patterns []string
+	key      ssh.PublicKey
+}
+
+// KnownHosts returns a host key callback that accepts only keys listed for
+// the host in files, which are in the known_hosts format described in
+// sshd(8), e.g. ~/.ssh/known_hosts.  Hashed host names, wildcards and
+// negated patterns are understood.  Keys marked @revoked are rejected, and
+// @cert-authority entries and lines that can't be parsed are ignored, as
+// are missing files.  Hosts are looked up by the name they were dialled
+// with, not their address.
+func KnownHosts(files ...string) (ssh.HostKeyCallback, error) {
+	var hosts []knownHost
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading known hosts: %v", err)
+		}
+		for _, line := range bytes.Split(b, []byte("\n")) {
+			marker, patterns, key, _, _, err := ssh.ParseKnownHosts(line)
+			if err != nil || marker == "cert-authority" {
+				continue
+			}
+			hosts = append(hosts, knownHost{revoked: marker == "revoked", patterns: patterns, key: key})
+		}
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		name := knownHostName(hostname)
+		listed := false
+		for _, h := range hosts {
+			if !h.matches(name) {
+				continue
+			}
+			same := bytes.Equal(h.key.Marshal(), key.Marshal())
+			switch {
+			case h.revoked && same:
+				return fmt.Errorf("host key for %s is revoked", name)
+			case h.revoked:
+			case same:
+				return nil
+			default:
+				listed = true
+			}
+		}
+		if listed {
+			return fmt.Errorf("host key mismatch for %s: got %s key %s", name, key.Type(), ssh.FingerprintSHA256(key))
+		}
+		return fmt.Errorf("no host key known for %s: got %s key %s", name, key.Type(), ssh.FingerprintSHA256(key))
+	}, nil
+}
+
+// knownHostName returns the name under which known_hosts lists hostport:
+// just the host for port 22, otherwise [host]:port, lowercased as by ssh(1).
+func knownHostName(hostport string) string {
+	hostport = strings.ToLower(hostport)
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	if port == fmt.Sprint(defaultSshPort) {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// matches returns true if name matches one of h's patterns and none of its
+// negated ones.
+func (h knownHost) matches(name string) bool {
+	matched := false
+	for _, p := range h.patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchHostPattern(p[1:], name) {
+				return false
+			}
+		} else if matchHostPattern(p, name) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchHostPattern returns true if name matches p, which is either hashed,
+// as |1|salt|hash, or may contain the wildcards * and ?.
+func matchHostPattern(p, name string) bool {
+	if strings.HasPrefix(p, "|1|") {
+		f := strings.Split(p[3:], "|")
+		if len(f) != 2 {
+			return false
+		}
+		salt, err1 := base64.StdEncoding.DecodeString(f[0])
+		sum, err2 := base64.StdEncoding.DecodeString(f[1])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		io.WriteString(mac, name)
+		return hmac.Equal(mac.Sum(nil), sum)
+	}
+	return wildcardMatch(p, name)
+}
+
+// wildcardMatch matches s against p, in which * matches any run of
+// characters and ? any one character.
+func wildcardMatch(p, s string) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(p[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || p[0] != s[0] {
+				return false
+			}
+		}
+		p, s = p[1:], s[1:]
+	}
+	return len(s) == 0
+}
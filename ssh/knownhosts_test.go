@@ -0,0 +1,86 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("error converting key: %v", err)
+	}
+	return pub
+}
+
+func TestKnownHosts(t *testing.T) {
+	k1, k2, k3 := newHostKey(t), newHostKey(t), newHostKey(t)
+	line := func(hosts string, k ssh.PublicKey) string {
+		return hosts + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k)))
+	}
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("hashed.example.com"))
+	hashed := fmt.Sprintf("|1|%s|%s", base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	dir, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "known_hosts")
+	content := strings.Join([]string{
+		"# comment",
+		line("db.example.com,10.0.0.1", k1),
+		line("[db.example.com]:2222", k2),
+		line(hashed, k1),
+		line("*.wild.example.com,!bad.wild.example.com", k1),
+		"@revoked " + line("*", k3),
+		"garbage",
+	}, "\n")
+	if err := ioutil.WriteFile(f, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cb, err := KnownHosts(f, filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatalf("error loading known hosts: %v", err)
+	}
+	for _, tc := range []struct {
+		host string
+		key  ssh.PublicKey
+		ok   bool
+	}{
+		{"db.example.com:22", k1, true},
+		{"DB.example.com:22", k1, true},
+		{"db.example.com:22", k2, false},
+		{"db.example.com:2222", k2, true},
+		{"db.example.com:2222", k1, false},
+		{"hashed.example.com:22", k1, true},
+		{"other.example.com:22", k1, false},
+		{"a.wild.example.com:22", k1, true},
+		{"bad.wild.example.com:22", k1, false},
+		{"db.example.com:22", k3, false},
+	} {
+		if err := cb(tc.host, nil, tc.key); (err == nil) != tc.ok {
+			t.Errorf("%s with key %s: expected ok=%v, got %v", tc.host, ssh.FingerprintSHA256(tc.key), tc.ok, err)
+		}
+	}
+}
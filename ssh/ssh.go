@@ -1,10 +1,15 @@
 package ssh
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/ncabatoff/piper"
 	"golang.org/x/crypto/ssh"
@@ -18,11 +23,24 @@ type (
 		*ssh.Session
 		launchdesc string
 		command    string
+		// ks serializes Start and Kill: a signal sent before the command
+		// has started would be ignored, so a Kill then is remembered.
+		ks *killState
+	}
+
+	killState struct {
+		mu      sync.Mutex
+		started bool
+		killed  bool
 	}
 
 	// Launcher implements piper.Launcher
 	Launcher struct {
 		*ssh.Client
+		// Addr is the host:port that was dialled, for ShellCommand.  If
+		// empty, the address of the remote end of the connection is used,
+		// which other hosts may not reach or know the host key of.
+		Addr string
 	}
 
 	readerDummyCloser struct {
@@ -34,6 +52,15 @@ func (r readerDummyCloser) Close() error {
 	return nil
 }
 
+// IsConnectionLost returns true if err shows that the ssh connection was lost
+// while running a command, rather than the command itself failing.  It's
+// suitable for use as piper.Retry.Transient.
+func IsConnectionLost(err error) bool {
+	var eme *ssh.ExitMissingError
+	var ne net.Error
+	return errors.As(err, &eme) || errors.As(err, &ne) || errors.Is(err, io.EOF)
+}
+
 // NewClient creates an ssh client.
 func NewClient(hostname string, port int, cfg ssh.ClientConfig) (*ssh.Client, error) {
 	hostport := net.JoinHostPort(hostname, fmt.Sprintf("%d", port))
@@ -69,6 +96,21 @@ func (l Launcher) String() string {
 	return fmt.Sprintf("%s@%s", user, hostport)
 }
 
+// ShellCommand implements the piper.RemoteShell interface by running
+// ssh(1) in batch mode, so that a missing key fails rather than prompts.
+func (l Launcher) ShellCommand(cmd string) string {
+	addr := l.Addr
+	if addr == "" {
+		addr = l.Client.Conn.RemoteAddr().String()
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, fmt.Sprintf("%d", defaultSshPort)
+	}
+	return fmt.Sprintf("ssh -o BatchMode=yes -p %s %s %s", port,
+		piper.ShellQuote(l.Client.Conn.User()+"@"+host), piper.ShellQuote(cmd))
+}
+
 // Close implements the piper.Launcher interface.
 func (l Launcher) Close() error {
 	return l.Client.Close()
@@ -87,7 +129,69 @@ func NewLauncher(user, host, keyfname string) (*Launcher, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Launcher{Client: client}, nil
+	return &Launcher{Client: client, Addr: net.JoinHostPort(host, strconv.Itoa(defaultSshPort))}, nil
+}
+
+// ParseTarget splits an ssh target of the form [user@]host[:port] into its
+// parts.  IPv6 hosts with a port must be bracketed, e.g. [::1]:2222.  A
+// missing user is returned as "" and a missing port as 22.
+func ParseTarget(target string) (username, host string, port int, err error) {
+	port = defaultSshPort
+	host = target
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		username, host = host[:i], host[i+1:]
+	}
+	if strings.HasPrefix(host, "[") || strings.Count(host, ":") == 1 {
+		var sport string
+		host, sport, err = net.SplitHostPort(host)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("invalid ssh target %q: %v", target, err)
+		}
+		port, err = strconv.Atoi(sport)
+		if err != nil || port <= 0 || port > 65535 {
+			return "", "", 0, fmt.Errorf("invalid ssh target %q: bad port %q", target, sport)
+		}
+	}
+	if host == "" {
+		return "", "", 0, fmt.Errorf("invalid ssh target %q: no host", target)
+	}
+	return username, host, port, nil
+}
+
+// Dial creates a Launcher for target, of the form accepted by ParseTarget,
+// authenticating with the private key in keyfname.  If target names no
+// user, the current user's name is used.  Host keys are not checked.
+func Dial(target, keyfname string) (*Launcher, error) {
+	return DialWith(target, keyfname, nil)
+}
+
+// DialWith is like Dial, but checks host keys with hostKey, e.g. one
+// returned by KnownHosts.  If hostKey is nil they're not checked.
+func DialWith(target, keyfname string, hostKey ssh.HostKeyCallback) (*Launcher, error) {
+	username, host, port, err := ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("can't determine ssh user for %q: %v", target, err)
+		}
+		username = u.Username
+	}
+	cfg, err := NewConfig(username, keyfname)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to configure ssh client: %v", err)
+	}
+	if hostKey != nil {
+		cfg.HostKeyCallback = hostKey
+	}
+
+	client, err := NewClient(host, port, *cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Launcher{Client: client, Addr: net.JoinHostPort(host, strconv.Itoa(port))}, nil
 }
 
 // Launch implements the piper.Launcher interface by creating a new ssh session.
@@ -97,19 +201,19 @@ func (l Launcher) Launch(command string) (piper.Executor, error) {
 		return nil, err
 	}
 
-	return &exe{launchdesc: l.String(), Session: sess, command: command}, nil
+	return &exe{launchdesc: l.String(), Session: sess, command: command, ks: &killState{}}, nil
 }
 
 // Errorf implements the piper.Launcher interface.
 func (l Launcher) Errorf(pat string, args ...interface{}) error {
 	pfx := fmt.Sprintf("%s: ", l)
-	return fmt.Errorf("%s: %v", pfx, fmt.Errorf(pat, args...))
+	return fmt.Errorf("%s: %w", pfx, fmt.Errorf(pat, args...))
 }
 
 // Errorf implements the piper.Executor interface.
 func (e exe) Errorf(pat string, args ...interface{}) error {
 	pfx := fmt.Sprintf("cmd %s{%s} :", e.launchdesc, e.command)
-	return fmt.Errorf("%s: %v", pfx, fmt.Errorf(pat, args...))
+	return fmt.Errorf("%s: %w", pfx, fmt.Errorf(pat, args...))
 }
 
 // Command implements the piper.Executor interface.
@@ -119,13 +223,25 @@ func (e exe) Command() string {
 
 // Run implements the piper.Executor interface.
 func (e exe) Run() error {
-	defer e.Session.Close()
-	return e.Session.Run(e.command)
+	if err := e.Start(); err != nil {
+		e.Session.Close()
+		return err
+	}
+	return e.Wait()
 }
 
 // Start implements the piper.Executor interface.
 func (e exe) Start() error {
-	return e.Session.Start(e.command)
+	e.ks.mu.Lock()
+	defer e.ks.mu.Unlock()
+	if e.ks.killed {
+		return fmt.Errorf("killed before starting")
+	}
+	if err := e.Session.Start(e.command); err != nil {
+		return err
+	}
+	e.ks.started = true
+	return nil
 }
 
 // Wait implements the piper.Executor interface.
@@ -136,6 +252,12 @@ func (e exe) Wait() error {
 
 // Kill implements the piper.Executor interface.
 func (e exe) Kill() error {
+	e.ks.mu.Lock()
+	defer e.ks.mu.Unlock()
+	e.ks.killed = true
+	if !e.ks.started {
+		return nil
+	}
 	return e.Session.Signal(ssh.SIGKILL)
 }
 
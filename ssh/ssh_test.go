@@ -8,6 +8,8 @@ import (
 	"github.com/ncabatoff/piper"
 	"github.com/ncabatoff/piper/local"
 	"github.com/ncabatoff/piper/test"
+	"golang.org/x/crypto/ssh"
+	"net"
 	"os/user"
 	"path"
 	"testing"
@@ -17,9 +19,59 @@ import (
 func TestInterfaces(t *testing.T) {
 	_ = piper.Launcher(Launcher{})
 	_ = piper.Executor(exe{})
+	_ = piper.RemoteShell(Launcher{})
 }
 
-func launcher(t *testing.T) *Launcher {
+func TestParseTarget(t *testing.T) {
+	for _, tc := range []struct {
+		target, user, host string
+		port               int
+	}{
+		{"example.com", "", "example.com", 22},
+		{"bob@example.com", "bob", "example.com", 22},
+		{"bob@example.com:2222", "bob", "example.com", 2222},
+		{"10.0.0.1:2222", "", "10.0.0.1", 2222},
+		{"::1", "", "::1", 22},
+		{"bob@[::1]:2222", "bob", "::1", 2222},
+	} {
+		user, host, port, err := ParseTarget(tc.target)
+		if err != nil || user != tc.user || host != tc.host || port != tc.port {
+			t.Errorf("ParseTarget(%q) = %q, %q, %d, %v; expected %q, %q, %d",
+				tc.target, user, host, port, err, tc.user, tc.host, tc.port)
+		}
+	}
+	for _, target := range []string{"", "bob@", "example.com:ssh", "example.com:0", "[::1"} {
+		if _, _, _, err := ParseTarget(target); err == nil {
+			t.Errorf("ParseTarget(%q) returned no error", target)
+		}
+	}
+}
+
+// fakeConn is just enough of an ssh.Conn for ShellCommand.
+type fakeConn struct {
+	ssh.Conn
+}
+
+func (fakeConn) User() string {
+	return "bob"
+}
+
+func (fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+}
+
+func TestShellCommand(t *testing.T) {
+	l := Launcher{Client: &ssh.Client{Conn: fakeConn{}}}
+	if got, want := l.ShellCommand("ls"), "ssh -o BatchMode=yes -p 22 'bob@10.0.0.1' 'ls'"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	l.Addr = "db.example.com:2222"
+	if got, want := l.ShellCommand("ls"), "ssh -o BatchMode=yes -p 2222 'bob@db.example.com' 'ls'"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func launcher(t testing.TB) *Launcher {
 	user, err := user.Current()
 	if err != nil {
 		t.Fatalf("can't get current user: %v", err)
@@ -52,3 +104,83 @@ func TestSshPipes(t *testing.T) {
 	// Test ssh -> ssh
 	test.PipeTest(t, l, l)
 }
+
+func TestSshPipeCodec(t *testing.T) {
+	test.PipeCodecTest(t, launcher(t), local.Launcher{}, piper.Gzip)
+}
+
+func TestSshPipeDirect(t *testing.T) {
+	l := launcher(t)
+	// ssh -> local can't be direct.
+	test.PipeDirectTest(t, l, local.Launcher{}, false)
+	// ssh -> ssh should be, provided localhost can ssh to itself.
+	test.PipeDirectTest(t, l, l, true)
+}
+
+func TestSshPipeOSPipe(t *testing.T) {
+	l := launcher(t)
+	test.PipeOSPipeTest(t, l, local.Launcher{}, false)
+	test.PipeOSPipeTest(t, l, l, false)
+}
+
+func TestSshPipeline(t *testing.T) {
+	test.PipelineTest(t, launcher(t))
+}
+
+func TestSshPipeChecksum(t *testing.T) {
+	test.PipeChecksumTest(t, launcher(t), local.Launcher{})
+}
+
+func TestSshTranscript(t *testing.T) {
+	test.TranscriptTest(t, launcher(t))
+}
+
+func TestSshScan(t *testing.T) {
+	test.ScanTest(t, launcher(t))
+}
+
+func TestSshJSON(t *testing.T) {
+	test.JSONTest(t, launcher(t))
+}
+
+func TestSshCaptureLimit(t *testing.T) {
+	test.CaptureLimitTest(t, launcher(t))
+}
+
+func TestSshStderrFunc(t *testing.T) {
+	test.StderrFuncTest(t, launcher(t))
+}
+
+func TestSshRetry(t *testing.T) {
+	test.RetryTest(t, launcher(t))
+}
+
+func TestSshRunAll(t *testing.T) {
+	test.RunAllTest(t, launcher(t))
+}
+
+func TestSshFanIn(t *testing.T) {
+	test.FanInTest(t, launcher(t))
+}
+
+func TestSshAudit(t *testing.T) {
+	test.AuditTest(t, launcher(t))
+}
+
+func TestSshConformance(t *testing.T) {
+	test.ConformanceTest(t, func(t *testing.T) piper.Launcher { return launcher(t) })
+}
+
+func BenchmarkSshToLocalPipe64M(b *testing.B) {
+	l := launcher(b)
+	test.PipeBenchmark(b, l, local.Launcher{}, 64<<20, piper.PipeOptions{})
+}
+
+func BenchmarkLocalToSshPipe64M(b *testing.B) {
+	test.PipeBenchmark(b, local.Launcher{}, launcher(b), 64<<20, piper.PipeOptions{})
+}
+
+func BenchmarkSshToSshPipe64M(b *testing.B) {
+	l := launcher(b)
+	test.PipeBenchmark(b, l, l, 64<<20, piper.PipeOptions{})
+}
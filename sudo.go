@@ -0,0 +1,363 @@
+package piper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Methods of privilege escalation for Sudo.
+const (
+	MethodSudo = "sudo"
+	MethodDoas = "doas"
+	MethodSu   = "su"
+)
+
+var (
+	// ErrPasswordRequired is wrapped by the error from a command run via
+	// Sudo when escalation needed a password and none was given.
+	ErrPasswordRequired = errors.New("password required")
+	// ErrPasswordRejected is wrapped by the error from a command run via
+	// Sudo when escalation rejected the password given.
+	ErrPasswordRejected = errors.New("password rejected")
+)
+
+// maxSudoStderr bounds how much stderr we keep from before escalation, for
+// use in error messages.
+const maxSudoStderr = 4 << 10
+
+type (
+	// Sudo wraps an existing launcher to run its commands as another user
+	// via sudo(8), doas(1) or su(1).  Commands are run non-interactively,
+	// so if a password is needed but not given they fail with an error
+	// wrapping ErrPasswordRequired rather than hanging.
+	Sudo struct {
+		Launcher
+		// Method is one of the Method constants; the default is sudo.
+		Method string
+		// User is who to run commands as; the default is root.
+		User string
+		// Password, if non-empty, is fed to sudo when it asks for one.
+		// Only sudo supports this, since doas and su read passwords from
+		// a terminal.  It's written to the command's stdin before any
+		// of the caller's stdin, which is held back until the command
+		// proper is running.
+		Password string
+	}
+
+	// sudoexe implements Executor by running a command via escalation,
+	// watching its stderr for the password prompt and for a marker
+	// written once escalation has succeeded.
+	sudoexe struct {
+		Executor
+		l       Sudo
+		command string
+		prompt  []byte
+		marker  []byte
+		// stdinr and stderrw are the other ends of the pipes given to our
+		// caller, or nil if they weren't asked for.
+		stdinr  *io.PipeReader
+		stderrw *io.PipeWriter
+		// ready is closed once escalation has succeeded, and done once
+		// the command's stderr has been consumed.
+		ready chan struct{}
+		done  chan struct{}
+		// pre is stderr from before escalation, and prompts counts the
+		// password prompts in it.
+		pre     bytes.Buffer
+		prompts int
+		// started is set once the command has been started.
+		started bool
+	}
+)
+
+// method returns the escalation method.
+func (l Sudo) method() string {
+	if l.Method == "" {
+		return MethodSudo
+	}
+	return l.Method
+}
+
+// user returns who commands are run as.
+func (l Sudo) user() string {
+	if l.User == "" {
+		return "root"
+	}
+	return l.User
+}
+
+// String implements the Launcher interface.
+func (l Sudo) String() string {
+	if l.User == "" {
+		return fmt.Sprintf("%s+%s", l.Launcher, l.method())
+	}
+	return fmt.Sprintf("%s+%s:%s", l.Launcher, l.method(), l.User)
+}
+
+// wrap returns cmd rewritten to run as l.User, first writing marker on
+// stderr.  prompt is the prompt sudo should use if asked for a password.
+func (l Sudo) wrap(cmd, prompt, marker string) (string, error) {
+	script := ShellQuote("printf '%s\\n' " + marker + " >&2\n" + cmd)
+	switch l.method() {
+	case MethodSudo:
+		args := "sudo -n"
+		if l.Password != "" {
+			args = "sudo -S -p " + ShellQuote(prompt)
+		}
+		if l.User != "" {
+			args += " -u " + ShellQuote(l.User)
+		}
+		return args + " -- sh -c " + script, nil
+	case MethodDoas:
+		args := "doas -n"
+		if l.User != "" {
+			args += " -u " + ShellQuote(l.User)
+		}
+		return args + " sh -c " + script, nil
+	case MethodSu:
+		return "su " + ShellQuote(l.user()) + " -c " + script, nil
+	}
+	return "", fmt.Errorf("unknown escalation method %q", l.Method)
+}
+
+// Launch implements the Launcher interface.
+func (l Sudo) Launch(cmd string) (Executor, error) {
+	if l.Password != "" && l.method() != MethodSudo {
+		return nil, fmt.Errorf("%s can't be given a password, only sudo can", l.method())
+	}
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(nonce[:])
+	e := &sudoexe{
+		l:       l,
+		command: cmd,
+		prompt:  []byte("[piper-sudo-password-" + id + "]"),
+		marker:  []byte("piper-sudo-ready-" + id),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	wrapped, err := l.wrap(cmd, string(e.prompt), string(e.marker))
+	if err != nil {
+		return nil, err
+	}
+	if e.Executor, err = l.Launcher.Launch(wrapped); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Errorf implements the Executor interface.
+func (e *sudoexe) Errorf(pat string, args ...interface{}) error {
+	pfx := fmt.Sprintf("cmd %s{%s} :", e.l, e.command)
+	return fmt.Errorf("%s: %w", pfx, fmt.Errorf(pat, args...))
+}
+
+// Command implements the Executor interface by returning the command as
+// given, not as rewritten.
+func (e *sudoexe) Command() string {
+	return e.command
+}
+
+// StdinPipe implements the Executor interface.  When feeding a password,
+// what's written is held back until escalation has succeeded.
+func (e *sudoexe) StdinPipe() (io.WriteCloser, error) {
+	if e.l.Password == "" {
+		return e.Executor.StdinPipe()
+	}
+	r, w := io.Pipe()
+	e.stdinr = r
+	return w, nil
+}
+
+// StderrPipe implements the Executor interface.  Our prompt and marker are
+// removed from what's read.
+func (e *sudoexe) StderrPipe() (io.ReadCloser, error) {
+	r, w := io.Pipe()
+	e.stderrw = w
+	return r, nil
+}
+
+// Start implements the Executor interface.
+func (e *sudoexe) Start() error {
+	stderr, err := e.Executor.StderrPipe()
+	if err != nil {
+		return err
+	}
+	var stdin io.WriteCloser
+	if e.l.Password != "" {
+		if stdin, err = e.Executor.StdinPipe(); err != nil {
+			return err
+		}
+	}
+	if err := e.Executor.Start(); err != nil {
+		if e.stderrw != nil {
+			e.stderrw.Close()
+		}
+		return err
+	}
+	e.started = true
+	go e.watch(stderr, stdin)
+	if stdin != nil {
+		go e.feed(stdin)
+	}
+	return nil
+}
+
+// Run implements the Executor interface.
+func (e *sudoexe) Run() error {
+	if err := e.Start(); err != nil {
+		return err
+	}
+	return e.Wait()
+}
+
+// escalated returns true if escalation has succeeded.
+func (e *sudoexe) escalated() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// watch copies stderr to our caller, answering password prompts on stdin
+// until the marker appears.
+func (e *sudoexe) watch(stderr io.Reader, stdin io.Writer) {
+	defer close(e.done)
+	var out io.Writer = ioutil.Discard
+	if e.stderrw != nil {
+		out = e.stderrw
+		defer e.stderrw.Close()
+	}
+	// Before escalation, we hold back anything after the last newline,
+	// since it might be the start of the prompt or marker.
+	var buf []byte
+	chunk := make([]byte, 4096)
+	marker := append(append([]byte(nil), e.marker...), '\n')
+	for !e.escalated() {
+		n, err := stderr.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		for {
+			if i := bytes.Index(buf, e.prompt); i >= 0 {
+				e.emit(out, buf[:i])
+				buf = buf[i+len(e.prompt):]
+				e.prompts++
+				if e.prompts > 1 {
+					// sudo would keep asking; give up.
+					e.Executor.Kill()
+					continue
+				}
+				io.WriteString(stdin, e.l.Password+"\n")
+				continue
+			}
+			if i := bytes.Index(buf, marker); i >= 0 {
+				e.emit(out, buf[:i])
+				buf = buf[i+len(marker):]
+				close(e.ready)
+			}
+			break
+		}
+		if e.escalated() {
+			break
+		}
+		if err != nil {
+			e.emit(out, buf)
+			return
+		}
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			e.emit(out, buf[:i+1])
+			buf = buf[i+1:]
+		}
+	}
+	out.Write(buf)
+	io.Copy(out, stderr)
+}
+
+// emit writes stderr from before escalation to out, keeping some of it
+// for error messages.
+func (e *sudoexe) emit(out io.Writer, p []byte) {
+	if room := maxSudoStderr - e.pre.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		e.pre.Write(p[:room])
+	}
+	out.Write(p)
+}
+
+// feed copies our caller's stdin, if any, to the command's once escalation
+// has succeeded.
+func (e *sudoexe) feed(stdin io.WriteCloser) {
+	var once sync.Once
+	fail := func(err error) {
+		once.Do(func() {
+			if e.stdinr != nil {
+				e.stdinr.CloseWithError(err)
+			}
+		})
+	}
+	defer stdin.Close()
+	select {
+	case <-e.ready:
+	case <-e.done:
+		fail(fmt.Errorf("%s exited before running the command", e.l.method()))
+		return
+	}
+	if e.stdinr == nil {
+		return
+	}
+	if _, err := io.Copy(stdin, e.stdinr); err != nil {
+		fail(err)
+	}
+}
+
+// Wait implements the Executor interface.  If escalation failed, the error
+// says why.
+func (e *sudoexe) Wait() error {
+	if !e.started {
+		return e.Executor.Wait()
+	}
+	<-e.done
+	err := e.Executor.Wait()
+	if e.escalated() {
+		return err
+	}
+	pre := strings.TrimSpace(e.pre.String())
+	how := fmt.Sprintf("%s as %s", e.l.method(), e.l.user())
+	switch {
+	case e.prompts > 1:
+		return e.Errorf("%s: %w", how, ErrPasswordRejected)
+	case passwordRequired(pre):
+		return e.Errorf("%s: %w: %s", how, ErrPasswordRequired, pre)
+	case err != nil:
+		return e.Errorf("%s failed: %w: %s", how, err, pre)
+	}
+	return e.Errorf("%s exited without running the command: %s", how, pre)
+}
+
+// passwordRequired returns true if stderr from sudo, doas or su shows that
+// they gave up for want of a password.
+func passwordRequired(stderr string) bool {
+	for _, s := range []string{
+		"a password is required",      // sudo -n
+		"Authentication required",     // doas -n
+		"must be run from a terminal", // su
+		"a terminal is required",      // sudo without -S
+		"Authentication failure",      // su
+	} {
+		if strings.Contains(stderr, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ncabatoff/piper"
+)
+
+// PipeBenchmark measures Pipe moving size bytes of zeroes from lchsrc to
+// lchsnk with opts.  Besides throughput and allocations, it reports the CPU
+// time our own process spends per op, which is what a relaying Pipe costs us.
+func PipeBenchmark(b *testing.B, lchsrc, lchsnk piper.Launcher, size int64, opts piper.PipeOptions) {
+	src := piper.Launchable{Launcher: lchsrc, Cmd: fmt.Sprintf("head -c %d /dev/zero", size)}
+	snk := piper.Launchable{Launcher: lchsnk, Cmd: "cat > /dev/null"}
+	b.SetBytes(size)
+	b.ReportAllocs()
+	cpu := cpuTime()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pr := piper.PipeWith(src, snk, opts)
+		if pr.Err != nil {
+			b.Fatalf("error piping: %v", pr.Err)
+		}
+		if pr.Bytes != size && !pr.Direct && !pr.OSPipe {
+			b.Fatalf("expected %d bytes piped, got %d", size, pr.Bytes)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime()-cpu)/float64(b.N), "cpu-ns/op")
+}
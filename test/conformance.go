@@ -0,0 +1,265 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/piper"
+)
+
+// ConformanceTest runs the whole suite of launcher tests.  newlch must return
+// a fresh launcher each time it's called, since some tests Close theirs; it's
+// given the subtest's t for reporting failures.
+func ConformanceTest(t *testing.T, newlch func(*testing.T) piper.Launcher) {
+	for _, tc := range []struct {
+		name string
+		f    func(*testing.T, piper.Launcher)
+	}{
+		{"RunCmd", RunCmdTest},
+		{"RunCmdIn", RunCmdInTest},
+		{"Capture", CaptureTest},
+		{"Pipe", func(t *testing.T, lch piper.Launcher) { PipeTest(t, lch, lch) }},
+		{"LargePayload", LargePayloadTest},
+		{"StderrInterleave", StderrInterleaveTest},
+		{"Kill", KillTest},
+		{"SinkExitsEarly", SinkExitsEarlyTest},
+		{"WaitBeforeDrain", WaitBeforeDrainTest},
+		{"PipeOpenFailure", PipeOpenFailureTest},
+		{"Concurrency", ConcurrencyTest},
+		{"CloseInFlight", CloseInFlightTest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lch := newlch(t)
+			defer lch.Close()
+			tc.f(t, lch)
+		})
+	}
+}
+
+// within fails t if f doesn't return within d.
+func within(t *testing.T, d time.Duration, what string, f func()) {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatalf("%s didn't complete within %v", what, d)
+	}
+}
+
+// LargePayloadTest verifies that binary data of several MB survives both
+// stdin/stdout and a Pipe intact.
+func LargePayloadTest(t *testing.T, lch piper.Launcher) {
+	payload := make([]byte, 4<<20)
+	rand.Read(payload)
+	stdout, _, err := piper.RunCmdStrInCapture(lch, "cat", string(payload))
+	if err != nil {
+		t.Errorf("error running cat: %v", err)
+	}
+	if stdout != string(payload) {
+		t.Errorf("payload of %d bytes came back as %d different bytes", len(payload), len(stdout))
+	}
+
+	src := piper.Launchable{Launcher: lch, Cmd: "head -c 4194304 /dev/urandom"}
+	snk := piper.Launchable{Launcher: lch, Cmd: "sha256sum"}
+	pr := piper.PipeWith(src, snk, piper.PipeOptions{Hash: sha256.New})
+	if pr.Err != nil {
+		t.Errorf("error piping: %v", pr.Err)
+	}
+	if pr.Bytes != 4<<20 {
+		t.Errorf("expected %d bytes piped, got %d", 4<<20, pr.Bytes)
+	}
+	if f := strings.Fields(pr.SnkStdout); len(f) == 0 || f[0] != pr.Digest {
+		t.Errorf("sink computed digest %q, piped digest %s", pr.SnkStdout, pr.Digest)
+	}
+}
+
+// StderrInterleaveTest verifies that heavy interleaved writes to stdout and
+// stderr are captured completely and in order on each stream.
+func StderrInterleaveTest(t *testing.T, lch piper.Launcher) {
+	const n = 2000
+	var wantout, wanterr bytes.Buffer
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&wantout, "out%d\n", i)
+		fmt.Fprintf(&wanterr, "err%d\n", i)
+	}
+	cmd := fmt.Sprintf("i=1; while [ $i -le %d ]; do echo out$i; echo err$i >&2; i=$((i+1)); done", n)
+	stdout, stderr, err := piper.RunCmdCapture(lch, cmd)
+	if err != nil {
+		t.Errorf("error running: %v", err)
+	}
+	if stdout != wantout.String() || stderr != wanterr.String() {
+		t.Errorf("interleaved output mangled: got %d/%d bytes of stdout/stderr, want %d/%d",
+			len(stdout), len(stderr), wantout.Len(), wanterr.Len())
+	}
+
+	pr := piper.Pipe(piper.Launchable{Launcher: lch, Cmd: cmd}, piper.Launchable{Launcher: lch, Cmd: "cat"})
+	if pr.Err != nil {
+		t.Errorf("error piping: %v", pr.Err)
+	}
+	if pr.SnkStdout != wantout.String() || pr.SrcStderr != wanterr.String() {
+		t.Errorf("interleaved pipe output mangled")
+	}
+}
+
+// KillTest verifies that Kill stops a command during Start, and before and
+// during Wait.
+func KillTest(t *testing.T, lch piper.Launcher) {
+	// Racing Kill against Start, it may land before, during or just after
+	// Start; whichever, the command mustn't run to completion.
+	for i := 0; i < 10; i++ {
+		exe, err := lch.Launch("sleep 30")
+		if err != nil {
+			t.Fatalf("error launching: %v", err)
+		}
+		killed := make(chan struct{})
+		go func() {
+			exe.Kill()
+			close(killed)
+		}()
+		within(t, 10*time.Second, "Kill during Start", func() {
+			serr := exe.Start()
+			<-killed
+			if werr := exe.Wait(); serr == nil && werr == nil {
+				t.Errorf("command killed during Start waited successfully")
+			}
+		})
+	}
+
+	for _, duringWait := range []bool{false, true} {
+		exe, err := lch.Launch("sleep 30")
+		if err != nil {
+			t.Fatalf("error launching: %v", err)
+		}
+		if err := exe.Start(); err != nil {
+			t.Fatalf("error starting: %v", err)
+		}
+		var werr error
+		within(t, 10*time.Second, fmt.Sprintf("Kill (during Wait: %v)", duringWait), func() {
+			if duringWait {
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					exe.Kill()
+				}()
+			} else if err := exe.Kill(); err != nil {
+				t.Errorf("error killing: %v", err)
+			}
+			werr = exe.Wait()
+		})
+		if werr == nil {
+			t.Errorf("killed command waited successfully (during Wait: %v)", duringWait)
+		}
+	}
+}
+
+// SinkExitsEarlyTest verifies that a Pipe completes when the sink exits
+// without consuming everything an endless source writes.
+func SinkExitsEarlyTest(t *testing.T, lch piper.Launcher) {
+	var pr piper.PipeResult
+	within(t, 30*time.Second, "Pipe to early-exiting sink", func() {
+		pr = piper.Pipe(piper.Launchable{Launcher: lch, Cmd: "yes"}, piper.Launchable{Launcher: lch, Cmd: "head -n 1"})
+	})
+	if pr.SnkStdout != "y\n" {
+		t.Errorf("expected %q, got %q", "y\n", pr.SnkStdout)
+	}
+}
+
+// WaitBeforeDrainTest verifies that the misuse of calling Wait before
+// consuming stdout doesn't wedge when the output fits in the pipe, and that
+// reading afterwards doesn't hang.
+func WaitBeforeDrainTest(t *testing.T, lch piper.Launcher) {
+	exe, err := lch.Launch("echo hi")
+	if err != nil {
+		t.Fatalf("error launching: %v", err)
+	}
+	stdout, err := exe.StdoutPipe()
+	if err != nil {
+		t.Fatalf("error opening stdout: %v", err)
+	}
+	if err := exe.Start(); err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	within(t, 10*time.Second, "Wait before drain", func() {
+		if err := exe.Wait(); err != nil {
+			t.Errorf("error waiting: %v", err)
+		}
+		ioutil.ReadAll(stdout)
+	})
+}
+
+// PipeOpenFailureTest verifies that opening a pipe twice, or after Start,
+// fails rather than misbehaving.
+func PipeOpenFailureTest(t *testing.T, lch piper.Launcher) {
+	exe, err := lch.Launch("cat")
+	if err != nil {
+		t.Fatalf("error launching: %v", err)
+	}
+	if _, err := exe.StdoutPipe(); err != nil {
+		t.Fatalf("error opening stdout: %v", err)
+	}
+	if _, err := exe.StdoutPipe(); err == nil {
+		t.Errorf("opening stdout twice succeeded")
+	}
+	stdin, err := exe.StdinPipe()
+	if err != nil {
+		t.Fatalf("error opening stdin: %v", err)
+	}
+	if err := exe.Start(); err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	if _, err := exe.StderrPipe(); err == nil {
+		t.Errorf("opening stderr after Start succeeded")
+	}
+	stdin.Close()
+	exe.Wait()
+}
+
+// ConcurrencyTest verifies that many commands can run at once via one
+// launcher without their output getting mixed up.
+func ConcurrencyTest(t *testing.T, lch piper.Launcher) {
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := fmt.Sprintf("%d-%d", i, rand.Int31())
+			stdout, _, err := piper.RunCmdStrInCapture(lch, "cat", want)
+			if err != nil || stdout != want {
+				t.Errorf("concurrent cat %d: expected %q, got %q, %v", i, want, stdout, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// CloseInFlightTest verifies that closing a launcher while one of its
+// commands runs doesn't leave Wait hanging.
+func CloseInFlightTest(t *testing.T, lch piper.Launcher) {
+	exe, err := lch.Launch("sleep 2")
+	if err != nil {
+		t.Fatalf("error launching: %v", err)
+	}
+	stdout, err := exe.StdoutPipe()
+	if err != nil {
+		t.Fatalf("error opening stdout: %v", err)
+	}
+	if err := exe.Start(); err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	within(t, 30*time.Second, "Wait after Close", func() {
+		lch.Close()
+		io.Copy(ioutil.Discard, stdout)
+		exe.Wait()
+	})
+}
@@ -0,0 +1,8 @@
+//go:build windows
+// +build windows
+
+package test
+
+func cpuTime() int64 {
+	return 0
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package test
+
+import "syscall"
+
+// cpuTime returns the user plus system CPU time used by our process, in ns.
+func cpuTime() int64 {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return ru.Utime.Nano() + ru.Stime.Nano()
+}
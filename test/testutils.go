@@ -1,10 +1,25 @@
 package test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ncabatoff/piper"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func RunCmdTest(t *testing.T, lch piper.Launcher) {
@@ -36,7 +51,7 @@ func RunCmdInTest(t *testing.T, lch piper.Launcher) {
 
 // CaptureTest runs a command whose output is captured.
 func CaptureTest(t *testing.T, lch piper.Launcher) {
-	payload := fmt.Sprintf("%d", rand.Int31)
+	payload := fmt.Sprintf("%d", rand.Int31())
 	stdout, stderr, err := piper.RunCmdCapture(lch, "echo -n "+payload)
 	if stderr != "" || err != nil {
 		t.Errorf("ssh produced errors, err=%v stderr=%q", err, stderr)
@@ -50,9 +65,9 @@ func CaptureTest(t *testing.T, lch piper.Launcher) {
 // by having the source emit something which the
 // sink reads and passes through to stdout.
 func PipeTest(t *testing.T, lchsrc, lchsnk piper.Launcher) {
-	payload := fmt.Sprintf("%d", rand.Int31)
-	src := piper.Launchable{lchsrc, "echo -n " + payload}
-	snk := piper.Launchable{lchsnk, "cat"}
+	payload := fmt.Sprintf("%d", rand.Int31())
+	src := piper.Launchable{Launcher: lchsrc, Cmd: "echo -n " + payload}
+	snk := piper.Launchable{Launcher: lchsnk, Cmd: "cat"}
 
 	pr := piper.Pipe(src, snk)
 	if pr.Err != nil {
@@ -63,3 +78,995 @@ func PipeTest(t *testing.T, lchsrc, lchsnk piper.Launcher) {
 		t.Errorf("expected %q, got %q", payload, pr.SnkStdout)
 	}
 }
+
+// PipeCodecTest verifies that Pipe() compresses and decompresses correctly
+// with codec, whether the codec runs on the hosts or in-process.
+func PipeCodecTest(t *testing.T, lchsrc, lchsnk piper.Launcher, codec piper.Codec) {
+	payload := strings.Repeat(fmt.Sprintf("%d\n", rand.Int31()), 1000)
+	src := piper.Launchable{Launcher: lchsrc, Cmd: "printf %s '" + payload + "'"}
+	snk := piper.Launchable{Launcher: lchsnk, Cmd: "cat"}
+
+	for _, opts := range []piper.PipeOptions{
+		{Codec: &codec},
+		{Codec: &codec, CompressHere: true},
+		{Codec: &codec, DecompressHere: true},
+	} {
+		pr := piper.PipeWith(src, snk, opts)
+		if pr.Err != nil {
+			t.Errorf("error piping with %+v: %v", opts, pr.Err)
+		}
+		if pr.SnkStdout != payload {
+			t.Errorf("with %+v expected %d bytes, got %d", opts, len(payload), len(pr.SnkStdout))
+		}
+	}
+
+	// The source's exit status must survive the injected compressor.
+	src.Cmd = "echo foo; exit 3"
+	pr := piper.PipeWith(src, snk, piper.PipeOptions{Codec: &codec})
+	if pr.Err == nil {
+		t.Errorf("failing source with codec returned success")
+	}
+
+	pr = piper.PipeWith(src, snk, piper.PipeOptions{Codec: &codec, CompressHere: true, DecompressHere: true})
+	if pr.Err == nil || !strings.Contains(pr.Err.Error(), "both compress and decompress") {
+		t.Errorf("expected error compressing and decompressing in-process, got %v", pr.Err)
+	}
+}
+
+// PipeDirectTest verifies Pipe() with the Direct option, checking whether
+// the data was relayed or went direct as expected.
+func PipeDirectTest(t *testing.T, lchsrc, lchsnk piper.Launcher, direct bool) {
+	payload := fmt.Sprintf("%d", rand.Int31())
+	src := piper.Launchable{Launcher: lchsrc, Cmd: "echo -n " + payload}
+	snk := piper.Launchable{Launcher: lchsnk, Cmd: "cat"}
+
+	pr := piper.PipeWith(src, snk, piper.PipeOptions{Direct: true})
+	if pr.Err != nil {
+		t.Errorf("error piping: %v", pr.Err)
+	}
+	if pr.Direct != direct {
+		t.Errorf("expected Direct=%v, got %v", direct, pr.Direct)
+	}
+	if pr.SnkStdout != payload {
+		t.Errorf("expected %q, got %q", payload, pr.SnkStdout)
+	}
+
+	// Hashing needs the data to pass through us, so it mustn't go direct.
+	pr = piper.PipeWith(src, snk, piper.PipeOptions{Direct: true, Hash: sha256.New})
+	if pr.Err != nil || pr.Direct || pr.SnkStdout != payload {
+		t.Errorf("expected %q relayed, got %q, Direct=%v, %v", payload, pr.SnkStdout, pr.Direct, pr.Err)
+	}
+	if pr.Bytes != int64(len(payload)) || pr.Digest == "" {
+		t.Errorf("expected %d bytes hashed, got %d, digest %q", len(payload), pr.Bytes, pr.Digest)
+	}
+}
+
+// PipeOSPipeTest verifies that Pipe() connects the source and sink with an
+// OS pipe when expected, and relays the data instead when progress is
+// requested, reporting progress that adds up to what was piped.
+func PipeOSPipeTest(t *testing.T, lchsrc, lchsnk piper.Launcher, ospipe bool) {
+	payload := fmt.Sprintf("%d", rand.Int31())
+	src := piper.Launchable{Launcher: lchsrc, Cmd: "echo -n " + payload}
+	snk := piper.Launchable{Launcher: lchsnk, Cmd: "cat"}
+
+	pr := piper.Pipe(src, snk)
+	if pr.Err != nil {
+		t.Errorf("error piping: %v", pr.Err)
+	}
+	if pr.OSPipe != ospipe {
+		t.Errorf("expected OSPipe=%v, got %v", ospipe, pr.OSPipe)
+	}
+	if pr.SnkStdout != payload {
+		t.Errorf("expected %q, got %q", payload, pr.SnkStdout)
+	}
+
+	var progress int64
+	pr = piper.PipeWith(src, snk, piper.PipeOptions{Progress: func(n int64) { progress = n }})
+	if pr.Err != nil {
+		t.Errorf("error piping with progress: %v", pr.Err)
+	}
+	if pr.OSPipe {
+		t.Errorf("expected OSPipe=false when progress requested")
+	}
+	if pr.SnkStdout != payload {
+		t.Errorf("expected %q, got %q", payload, pr.SnkStdout)
+	}
+	if want := int64(len(payload)); pr.Bytes != want || progress != want {
+		t.Errorf("expected %d bytes, got %d with progress %d", want, pr.Bytes, progress)
+	}
+
+	pr = piper.PipeWith(src, snk, piper.PipeOptions{Relay: true})
+	if pr.Err != nil || pr.OSPipe || pr.SnkStdout != payload || pr.Bytes != int64(len(payload)) {
+		t.Errorf("expected %d bytes relayed when asked, got %+v", len(payload), pr)
+	}
+}
+
+// PipelineTest verifies Pipeline() with one, two and three stages, checking
+// output, per-stage stderr and errors, and that a failing stage is reported
+// as such.
+func PipelineTest(t *testing.T, lch piper.Launcher) {
+	stage := func(cmd string) piper.Launchable {
+		return piper.Launchable{Launcher: lch, Cmd: cmd}
+	}
+	pr := piper.Pipeline([]piper.Launchable{stage("echo hello")}, piper.PipelineOptions{})
+	if pr.Err != nil || pr.Stdout != "hello\n" || len(pr.Stages) != 1 {
+		t.Errorf("one stage: got %q, %d stages, %v", pr.Stdout, len(pr.Stages), pr.Err)
+	}
+
+	var mu sync.Mutex
+	var lines []string
+	opts := piper.PipelineOptions{StderrFunc: func(l piper.StderrLine) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, l.Stage+":"+l.Text)
+	}}
+	pr = piper.Pipeline([]piper.Launchable{
+		stage("echo hello; echo e0 >&2"),
+		stage("tr a-z A-Z; echo e1 >&2"),
+		stage("rev; echo e2 >&2"),
+	}, opts)
+	if pr.Err != nil {
+		t.Errorf("error running pipeline: %v", pr.Err)
+	}
+	if pr.Stdout != "OLLEH\n" {
+		t.Errorf("expected %q, got %q", "OLLEH\n", pr.Stdout)
+	}
+	for i, sr := range pr.Stages {
+		if want := fmt.Sprintf("e%d\n", i); sr.Stderr != want || sr.Err != nil {
+			t.Errorf("stage %d: expected stderr %q, got %q, %v", i, want, sr.Stderr, sr.Err)
+		}
+	}
+	sort.Strings(lines)
+	if want := []string{"filter:e1", "sink:e2", "source:e0"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("expected stderr lines %q, got %q", want, lines)
+	}
+
+	pr = piper.Pipeline([]piper.Launchable{stage("echo hello"), stage("cat; exit 3"), stage("cat")}, piper.PipelineOptions{})
+	if pr.Err == nil || pr.Stages[1].Err == nil || pr.Stages[2].Err != nil {
+		t.Errorf("expected only stage 1 to fail, got %v", pr.Err)
+	}
+	if pr.Stdout != "hello\n" {
+		t.Errorf("expected %q, got %q", "hello\n", pr.Stdout)
+	}
+
+	if pr = piper.Pipeline(nil, piper.PipelineOptions{}); pr.Err == nil {
+		t.Errorf("empty pipeline returned success")
+	}
+
+	// Stages launched but never started must be released, whether a
+	// later stage fails to launch or to start.
+	tl, fail := newTrackingLauncher(lch, 0), newTrackingLauncher(lch, 1)
+	fails := 1
+	tstage := func(l piper.Launcher, cmd string) piper.Launchable {
+		return piper.Launchable{Launcher: l, Cmd: cmd}
+	}
+	pr = piper.Pipeline([]piper.Launchable{tstage(tl, "echo hi"), tstage(tl, "cat"),
+		tstage(flakyLauncher{lch, &fails}, "cat")}, piper.PipelineOptions{})
+	if !piper.IsStartError(pr.Err) {
+		t.Errorf("expected StartError from failed launch, got %v", pr.Err)
+	}
+	pr = piper.Pipeline([]piper.Launchable{tstage(tl, "echo hi"), tstage(fail, "cat"),
+		tstage(tl, "cat")}, piper.PipelineOptions{})
+	if !piper.IsStartError(pr.Err) {
+		t.Errorf("expected StartError from failed start, got %v", pr.Err)
+	}
+	if n, m := atomic.LoadInt32(tl.outstanding), atomic.LoadInt32(fail.outstanding); n != 0 || m != 0 {
+		t.Errorf("expected every stage released, got %d and %d outstanding", n, m)
+	}
+}
+
+// PipeChecksumTest verifies that Pipe() reports the size and digest of the
+// data piped, and that verification commands are run and compared.
+func PipeChecksumTest(t *testing.T, lchsrc, lchsnk piper.Launcher) {
+	payload := fmt.Sprintf("%d", rand.Int31())
+	src := piper.Launchable{Launcher: lchsrc, Cmd: "echo -n " + payload}
+	snk := piper.Launchable{Launcher: lchsnk, Cmd: "cat"}
+	sum := sha256.Sum256([]byte(payload))
+	verify := piper.Verify{SrcCmd: "echo -n " + payload + " | sha256sum", SnkCmd: "echo -n " + payload + " | sha256sum"}
+
+	pr := piper.PipeWith(src, snk, piper.PipeOptions{Hash: sha256.New, Verify: &verify})
+	if pr.Err != nil {
+		t.Errorf("error piping: %v", pr.Err)
+	}
+	if pr.Bytes != int64(len(payload)) {
+		t.Errorf("expected %d bytes, got %d", len(payload), pr.Bytes)
+	}
+	if want := hex.EncodeToString(sum[:]); pr.Digest != want {
+		t.Errorf("expected digest %s, got %s", want, pr.Digest)
+	}
+
+	verify.SnkCmd = "echo -n x" + payload + " | sha256sum"
+	pr = piper.PipeWith(src, snk, piper.PipeOptions{Verify: &verify})
+	if pr.Err == nil {
+		t.Errorf("mismatched verification commands returned success")
+	}
+}
+
+// CaptureLimitTest verifies that captured output is bounded by CaptureLimit,
+// keeping its head and tail, for both RunCmdWith and Pipe.
+func CaptureLimitTest(t *testing.T, lch piper.Launcher) {
+	var full string
+	for i := 1; i <= 10000; i++ {
+		full += fmt.Sprintf("%d\n", i)
+	}
+	const limit = 100
+	check := func(what, got string, dropped int64) {
+		if want := int64(len(full) - 2*limit); dropped != want {
+			t.Errorf("%s: expected %d bytes dropped, got %d", what, want, dropped)
+		}
+		if !strings.HasPrefix(got, full[:limit]) || !strings.HasSuffix(got, full[len(full)-limit:]) {
+			t.Errorf("%s: head or tail missing from %q", what, got)
+		}
+		if !strings.Contains(got, fmt.Sprintf("%d bytes dropped", dropped)) {
+			t.Errorf("%s: no truncation marker in %q", what, got)
+		}
+	}
+
+	rr := piper.RunCmdWith(lch, "seq 1 10000; seq 1 10000 >&2", piper.RunOptions{Capture: true, CaptureLimit: limit})
+	if rr.Err != nil {
+		t.Errorf("error running seq: %v", rr.Err)
+	}
+	check("RunCmdWith stdout", rr.Stdout, rr.StdoutDropped)
+	check("RunCmdWith stderr", rr.Stderr, rr.StderrDropped)
+
+	src := piper.Launchable{Launcher: lch, Cmd: "seq 1 10000; seq 1 10000 >&2"}
+	snk := piper.Launchable{Launcher: lch, Cmd: "tee /dev/stderr"}
+	pr := piper.PipeWith(src, snk, piper.PipeOptions{CaptureLimit: limit})
+	if pr.Err != nil {
+		t.Errorf("error piping: %v", pr.Err)
+	}
+	check("Pipe source stderr", pr.SrcStderr, pr.SrcStderrDropped)
+	check("Pipe sink stdout", pr.SnkStdout, pr.SnkStdoutDropped)
+	check("Pipe sink stderr", pr.SnkStderr, pr.SnkStderrDropped)
+}
+
+// StderrFuncTest verifies that stderr lines are passed to a StderrFunc,
+// tagged with the right stage and launcher, by both RunCmdWith and Pipe.
+func StderrFuncTest(t *testing.T, lch piper.Launcher) {
+	var lines []piper.StderrLine
+	fn := func(l piper.StderrLine) {
+		lines = append(lines, l)
+	}
+	check := func(what string, want map[string][]string) {
+		got := make(map[string][]string)
+		for _, l := range lines {
+			if l.Launcher != lch.String() {
+				t.Errorf("%s: expected launcher %q, got %q", what, lch.String(), l.Launcher)
+			}
+			if l.Time.IsZero() {
+				t.Errorf("%s: line %q has no timestamp", what, l.Text)
+			}
+			got[l.Stage] = append(got[l.Stage], l.Text)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", what, want, got)
+		}
+		lines = nil
+	}
+
+	rr := piper.RunCmdWith(lch, "echo a >&2; printf b >&2", piper.RunOptions{Capture: true, StderrFunc: fn})
+	if rr.Err != nil {
+		t.Errorf("error running: %v", rr.Err)
+	}
+	if rr.Stderr != "a\nb" {
+		t.Errorf("expected stderr to still be captured, got %q", rr.Stderr)
+	}
+	check("RunCmdWith", map[string][]string{piper.StageCmd: {"a", "b"}})
+
+	src := piper.Launchable{Launcher: lch, Cmd: "echo a >&2; echo b >&2; echo payload"}
+	snk := piper.Launchable{Launcher: lch, Cmd: "cat; echo c >&2"}
+	pr := piper.PipeWith(src, snk, piper.PipeOptions{StderrFunc: fn})
+	if pr.Err != nil {
+		t.Errorf("error piping: %v", pr.Err)
+	}
+	check("Pipe", map[string][]string{piper.StageSource: {"a", "b"}, piper.StageSink: {"c"}})
+}
+
+// flakyLauncher fails to Launch until fails reaches zero.
+type flakyLauncher struct {
+	piper.Launcher
+	fails *int
+}
+
+func (f flakyLauncher) Launch(cmd string) (piper.Executor, error) {
+	if *f.fails > 0 {
+		*f.fails--
+		return nil, fmt.Errorf("flaky launch")
+	}
+	return f.Launcher.Launch(cmd)
+}
+
+// trackingLauncher counts the executors it has launched that haven't been
+// waited on, and fails the first startFails of them to Start.
+type trackingLauncher struct {
+	piper.Launcher
+	startFails  *int
+	outstanding *int32
+}
+
+type trackingExe struct {
+	piper.Executor
+	l trackingLauncher
+}
+
+func newTrackingLauncher(lch piper.Launcher, startFails int) trackingLauncher {
+	return trackingLauncher{lch, &startFails, new(int32)}
+}
+
+func (l trackingLauncher) Launch(cmd string) (piper.Executor, error) {
+	exe, err := l.Launcher.Launch(cmd)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(l.outstanding, 1)
+	return trackingExe{exe, l}, nil
+}
+
+func (e trackingExe) Start() error {
+	if *e.l.startFails > 0 {
+		*e.l.startFails--
+		return fmt.Errorf("tracked start failure")
+	}
+	return e.Executor.Start()
+}
+
+func (e trackingExe) Wait() error {
+	atomic.AddInt32(e.l.outstanding, -1)
+	return e.Executor.Wait()
+}
+
+// RetryTest verifies that Retry retries start failures, and transient
+// failures provided that's safe.
+func RetryTest(t *testing.T, lch piper.Launcher) {
+	fails := 2
+	flaky := flakyLauncher{lch, &fails}
+	if err := (piper.Retry{Attempts: 2}).RunCmd(flaky, "true"); !piper.IsStartError(err) {
+		t.Errorf("expected a StartError after 2 attempts, got %v", err)
+	}
+	fails = 2
+	if err := (piper.Retry{Attempts: 3}).RunCmd(flaky, "true"); err != nil {
+		t.Errorf("expected success after 3 attempts, got %v", err)
+	}
+	fails = 2
+	src := piper.Launchable{Launcher: flaky, Cmd: "echo -n foo"}
+	snk := piper.Launchable{Launcher: lch, Cmd: "cat"}
+	if pr := (piper.Retry{Attempts: 3}).Pipe(src, snk); pr.Err != nil || pr.SnkStdout != "foo" {
+		t.Errorf("expected pipe to succeed after 3 attempts, got %+v", pr)
+	}
+
+	// Executors launched for failed tries must be released.
+	tsrc, tsnk := newTrackingLauncher(lch, 2), newTrackingLauncher(lch, 0)
+	src = piper.Launchable{Launcher: tsrc, Cmd: "echo -n foo"}
+	snk = piper.Launchable{Launcher: tsnk, Cmd: "cat"}
+	if pr := (piper.Retry{Attempts: 3}).Pipe(src, snk); pr.Err != nil || pr.SnkStdout != "foo" {
+		t.Errorf("expected pipe to succeed after 3 attempts, got %+v", pr)
+	}
+	if n, m := atomic.LoadInt32(tsrc.outstanding), atomic.LoadInt32(tsnk.outstanding); n != 0 || m != 0 {
+		t.Errorf("expected every executor released, got %d sources and %d sinks outstanding", n, m)
+	}
+	// Commands that fail to start must be released too, without having
+	// consumed any of the input meant for the try that runs.
+	tl := newTrackingLauncher(lch, 2)
+	rr := (piper.Retry{Attempts: 3}).RunCmdWith(tl, "cat", piper.RunOptions{
+		StdinReader: strings.NewReader("foo"), Capture: true})
+	if rr.Err != nil || rr.Stdout != "foo" {
+		t.Errorf("expected %q after 3 attempts, got %q, %v", "foo", rr.Stdout, rr.Err)
+	}
+	if n := atomic.LoadInt32(tl.outstanding); n != 0 {
+		t.Errorf("expected every executor released, got %d outstanding", n)
+	}
+
+	tmp, _, err := piper.RunCmdCapture(lch, "mktemp")
+	if err != nil {
+		t.Fatalf("mktemp failed: %v", err)
+	}
+	tmp = strings.TrimSpace(tmp)
+	defer piper.RunCmd(lch, "rm -f "+tmp)
+	// Each run increments a counter in tmp and fails unless it's reached 3.
+	counter := fmt.Sprintf("n=$(($(cat %s) + 1)); echo $n > %s; ", tmp, tmp)
+	count := func() string {
+		n, _, _ := piper.RunCmdCapture(lch, "cat "+tmp)
+		return strings.TrimSpace(n)
+	}
+	transient := func(error) bool { return true }
+
+	retry := piper.Retry{Attempts: 5, Backoff: time.Millisecond, Jitter: 0.5, Transient: transient}
+	rr = retry.RunCmdWith(lch, counter+"[ $n -ge 3 ]", piper.RunOptions{Capture: true})
+	if rr.Err != nil || count() != "3" {
+		t.Errorf("expected success on try 3, got %v after %s tries", rr.Err, count())
+	}
+
+	piper.RunCmd(lch, "echo 0 > "+tmp)
+	rr = retry.RunCmdWith(lch, counter+"echo working; [ $n -ge 3 ]", piper.RunOptions{Capture: true})
+	if rr.Err == nil || count() != "1" {
+		t.Errorf("expected no retry after output, got %v after %s tries", rr.Err, count())
+	}
+
+	// A pipe that fails before moving any data is retried, even when
+	// both ends are local and could be joined by an OS pipe.
+	piper.RunCmd(lch, "echo 0 > "+tmp)
+	src = piper.Launchable{Launcher: lch, Cmd: counter + "[ $n -ge 3 ] && echo -n data"}
+	snk = piper.Launchable{Launcher: lch, Cmd: "cat"}
+	if pr := retry.Pipe(src, snk); pr.Err != nil || pr.SnkStdout != "data" || count() != "3" {
+		t.Errorf("expected pipe success on try 3, got %+v after %s tries", pr, count())
+	}
+
+	piper.RunCmd(lch, "echo 0 > "+tmp)
+	src.Cmd = counter + "echo -n data; [ $n -ge 3 ]"
+	snk.Cmd = "cat >/dev/null"
+	if pr := retry.Pipe(src, snk); pr.Err == nil || count() != "1" {
+		t.Errorf("expected no pipe retry after data moved, got %v after %s tries", pr.Err, count())
+	}
+
+	piper.RunCmd(lch, "echo 0 > "+tmp)
+	retry.Idempotent = true
+	rr = retry.RunCmdWith(lch, counter+"echo working; [ $n -ge 3 ]", piper.RunOptions{Capture: true})
+	if rr.Err != nil || count() != "3" {
+		t.Errorf("expected idempotent success on try 3, got %v after %s tries", rr.Err, count())
+	}
+}
+
+// named gives a launcher a distinct description.
+type named struct {
+	piper.Launcher
+	name string
+}
+
+func (n named) String() string {
+	return n.name
+}
+
+// RunAllTest verifies RunAll's results, concurrency options and timeout.
+func RunAllTest(t *testing.T, lch piper.Launcher) {
+	var lchs []piper.Launcher
+	for i := 0; i < 5; i++ {
+		lchs = append(lchs, named{lch, fmt.Sprintf("host%d", i)})
+	}
+
+	res := piper.RunAll(lchs, "echo hi; exit 3", piper.ParallelOptions{
+		RunOptions:  piper.RunOptions{Capture: true},
+		Concurrency: 2,
+	})
+	if len(res) != len(lchs) {
+		t.Errorf("expected %d results, got %d", len(lchs), len(res))
+	}
+	for _, l := range lchs {
+		hr := res[l.String()]
+		if hr.ExitStatus != 3 || hr.Stdout != "hi\n" || hr.Err == nil {
+			t.Errorf("%s: expected exit status 3 and output, got %+v", l, hr)
+		}
+	}
+
+	res = piper.RunAll(lchs, "false", piper.ParallelOptions{Concurrency: 1, StopOnFailure: true})
+	if err := res["host0"].Err; err == nil || err == piper.ErrNotRun {
+		t.Errorf("expected host0 to fail, got %v", err)
+	}
+	for _, l := range lchs[1:] {
+		if err := res[l.String()].Err; err != piper.ErrNotRun {
+			t.Errorf("%s: expected ErrNotRun, got %v", l, err)
+		}
+	}
+
+	// Without a bound, a failure must kill the commands already running.
+	fails := 1
+	stopping := append([]piper.Launcher{named{flakyLauncher{lch, &fails}, "bad"}}, lchs...)
+	start := time.Now()
+	res = piper.RunAll(stopping, "sleep 10", piper.ParallelOptions{StopOnFailure: true})
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("failure didn't stop running commands")
+	}
+	for _, l := range stopping {
+		if err := res[l.String()].Err; err == nil {
+			t.Errorf("%s: expected to be killed or not run, got success", l)
+		}
+	}
+
+	start = time.Now()
+	res = piper.RunAll(lchs, "sleep 10", piper.ParallelOptions{RunOptions: piper.RunOptions{Timeout: 100 * time.Millisecond}})
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("timeout didn't kill commands")
+	}
+	for _, l := range lchs {
+		if hr := res[l.String()]; hr.Err == nil || hr.Duration > 5*time.Second {
+			t.Errorf("%s: expected timeout, got %+v", l, hr)
+		}
+	}
+}
+
+// FanInTest verifies FanIn in both modes, with and without prefixes.
+func FanInTest(t *testing.T, lch piper.Launcher) {
+	var srcs []piper.Launchable
+	for _, s := range []string{"a", "b", "c"} {
+		srcs = append(srcs, piper.Launchable{Launcher: lch, Cmd: fmt.Sprintf("echo %s1; echo %s2 >&2; printf %s3", s, s, s)})
+	}
+	snk := piper.Launchable{Launcher: lch, Cmd: "cat"}
+
+	fr := piper.FanIn(srcs, snk, piper.FanInOptions{})
+	if fr.Err != nil {
+		t.Errorf("error fanning in: %v", fr.Err)
+	}
+	if want := "a1\na3b1\nb3c1\nc3"; fr.SnkStdout != want {
+		t.Errorf("expected %q, got %q", want, fr.SnkStdout)
+	}
+	for i, s := range []string{"a", "b", "c"} {
+		if fr.Sources[i].Stderr != s+"2\n" {
+			t.Errorf("source %d: expected stderr %q, got %q", i, s+"2\n", fr.Sources[i].Stderr)
+		}
+	}
+
+	prefix := func(src piper.Launchable) string {
+		return src.Cmd[5:6] + ": "
+	}
+	fr = piper.FanIn(srcs, snk, piper.FanInOptions{Mode: piper.Interleave, Prefix: prefix})
+	if fr.Err != nil {
+		t.Errorf("error fanning in: %v", fr.Err)
+	}
+	got := strings.Split(strings.TrimSuffix(fr.SnkStdout, "\n"), "\n")
+	sort.Strings(got)
+	want := []string{"a: a1", "a: a3", "b: b1", "b: b3", "c: c1", "c: c3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected lines %q, got %q", want, got)
+	}
+
+	srcs[1].Cmd = "echo b1; exit 2"
+	fr = piper.FanIn(srcs, snk, piper.FanInOptions{Mode: piper.Interleave})
+	if fr.Err == nil || fr.Sources[1].Err == nil || fr.Sources[0].Err != nil {
+		t.Errorf("expected only source 1 to fail, got %+v", fr)
+	}
+
+	// A source or sink that fails to start must still be released.
+	tsrc, tsnk := newTrackingLauncher(lch, 1), newTrackingLauncher(lch, 1)
+	fr = piper.FanIn([]piper.Launchable{{Launcher: tsrc, Cmd: "echo a"}}, piper.Launchable{Launcher: lch, Cmd: "cat"}, piper.FanInOptions{})
+	if !piper.IsStartError(fr.Sources[0].Err) {
+		t.Errorf("expected source start error, got %v", fr.Sources[0].Err)
+	}
+	fr = piper.FanIn(srcs, piper.Launchable{Launcher: tsnk, Cmd: "cat"}, piper.FanInOptions{})
+	if !piper.IsStartError(fr.Err) {
+		t.Errorf("expected sink start error, got %v", fr.Err)
+	}
+	if n, m := atomic.LoadInt32(tsrc.outstanding), atomic.LoadInt32(tsnk.outstanding); n != 0 || m != 0 {
+		t.Errorf("expected every executor released, got %d sources and %d sinks outstanding", n, m)
+	}
+}
+
+// AuditTest verifies the records written by an Audit launcher.
+func AuditTest(t *testing.T, lch piper.Launcher) {
+	var buf bytes.Buffer
+	// The zero value, bar the fields we set, must be usable.
+	a := piper.Audit{Launcher: lch, W: &buf, Streams: piper.AuditContent}
+	records := func() []piper.AuditRecord {
+		var ars []piper.AuditRecord
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var ar piper.AuditRecord
+			if err := dec.Decode(&ar); err != nil {
+				t.Fatalf("error decoding audit record: %v", err)
+			}
+			if ar.Launcher != lch.String() || ar.Time.IsZero() {
+				t.Errorf("record missing launcher or time: %+v", ar)
+			}
+			ars = append(ars, ar)
+		}
+		return ars
+	}
+
+	if _, _, err := piper.RunCmdStrInCapture(a, "cat; echo err >&2", "hello"); err != nil {
+		t.Errorf("error running cat: %v", err)
+	}
+	ars := records()
+	var events []string
+	for _, ar := range ars {
+		events = append(events, ar.Event)
+	}
+	if want := []string{"launch", "start", "wait"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("expected events %v, got %v", want, events)
+	}
+	wait := ars[2]
+	if wait.Command != "cat; echo err >&2" || wait.ExitStatus == nil || *wait.ExitStatus != 0 {
+		t.Errorf("unexpected wait record %+v", wait)
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	want := map[string]piper.AuditStream{
+		"stdin":  {Bytes: 5, SHA256: hex.EncodeToString(sum[:]), Content: []byte("hello")},
+		"stdout": {Bytes: 5, SHA256: hex.EncodeToString(sum[:]), Content: []byte("hello")},
+	}
+	for name, as := range want {
+		if !reflect.DeepEqual(wait.Streams[name], as) {
+			t.Errorf("expected %s %+v, got %+v", name, as, wait.Streams[name])
+		}
+	}
+	if string(wait.Streams["stderr"].Content) != "err\n" {
+		t.Errorf("expected stderr %q, got %+v", "err\n", wait.Streams["stderr"])
+	}
+
+	// Output that isn't valid UTF-8 must be recorded intact.
+	if _, _, err := piper.RunCmdCapture(a, `printf '\377\000\376'`); err != nil {
+		t.Errorf("error running printf: %v", err)
+	}
+	ars = records()
+	if got := ars[len(ars)-1].Streams["stdout"].Content; !bytes.Equal(got, []byte{0xff, 0, 0xfe}) {
+		t.Errorf("expected binary stdout to round-trip, got %q", got)
+	}
+
+	piper.RunCmd(a, "exit 3")
+	ars = records()
+	if last := ars[len(ars)-1]; last.Error == "" || last.ExitStatus == nil || *last.ExitStatus != 3 {
+		t.Errorf("expected exit status 3, got %+v", last)
+	}
+}
+
+// fakeSudo stands in for sudo(8).  It accepts the password "secret", or no
+// password if FAKE_SUDO_NOPASSWD is set, and runs the command with
+// FAKE_SUDO_USER set to the -u argument.
+const fakeSudo = `#!/bin/sh
+prompt= interactive=
+FAKE_SUDO_USER=root
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-n) shift ;;
+	-S) interactive=1; shift ;;
+	-p) prompt=$2; shift 2 ;;
+	-u) FAKE_SUDO_USER=$2; shift 2 ;;
+	--) shift; break ;;
+	*) break ;;
+	esac
+done
+export FAKE_SUDO_USER
+if [ -z "$FAKE_SUDO_NOPASSWD" ]; then
+	if [ -z "$interactive" ]; then
+		echo "sudo: a password is required" >&2
+		exit 1
+	fi
+	tries=0
+	while :; do
+		printf '%s' "$prompt" >&2
+		read -r pw || exit 1
+		[ "$pw" = secret ] && break
+		tries=$((tries+1))
+		if [ $tries -ge 3 ]; then
+			echo "sudo: 3 incorrect password attempts" >&2
+			exit 1
+		fi
+		echo "Sorry, try again." >&2
+	done
+fi
+exec "$@"
+`
+
+// FakeSudo puts a stand-in for sudo(8) first in our PATH for the rest of
+// the test, for use by SudoTest with a local launcher.
+func FakeSudo(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "sudo"), []byte(fakeSudo), 0755); err != nil {
+		t.Fatalf("error writing fake sudo: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// SudoTest verifies that the Sudo wrapper runs commands as the right user
+// with their streams intact, feeds a password without corrupting stdin,
+// and reports a missing or wrong password clearly.  lch's host must have
+// a sudo that behaves like the one FakeSudo provides.
+func SudoTest(t *testing.T, lch piper.Launcher) {
+	t.Setenv("FAKE_SUDO_NOPASSWD", "1")
+	l := piper.Sudo{Launcher: lch, User: "post'gres"}
+	stdout, stderr, err := piper.RunCmdCapture(l, `echo "$FAKE_SUDO_USER" 'a b'; echo err >&2`)
+	if err != nil {
+		t.Errorf("error running via sudo: %v", err)
+	}
+	if stdout != "post'gres a b\n" || stderr != "err\n" {
+		t.Errorf("expected stdout %q and stderr %q, got %q and %q", "post'gres a b\n", "err\n", stdout, stderr)
+	}
+	if err := piper.RunCmd(l, "exit 3"); piper.ExitStatus(err) != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+
+	t.Setenv("FAKE_SUDO_NOPASSWD", "")
+	_, _, err = piper.RunCmdCapture(l, "true")
+	if !errors.Is(err, piper.ErrPasswordRequired) {
+		t.Errorf("expected password required error, got %v", err)
+	}
+
+	payload := "line 1\nline 2\nsecret\n"
+	l.Password = "secret"
+	stdout, stderr, err = piper.RunCmdStrInCapture(l, "cat", payload)
+	if err != nil {
+		t.Errorf("error running via sudo with password: %v", err)
+	}
+	if stdout != payload || stderr != "" {
+		t.Errorf("expected stdout %q and no stderr, got %q and %q", payload, stdout, stderr)
+	}
+	if err := piper.RunCmd(l, "true"); err != nil {
+		t.Errorf("error running via sudo with password and no stdin: %v", err)
+	}
+	pr := piper.Pipe(piper.Launchable{Launcher: lch, Cmd: "printf '" + payload + "'"}, piper.Launchable{Launcher: l, Cmd: "cat"})
+	if pr.Err != nil || pr.SnkStdout != payload {
+		t.Errorf("expected %q piped via sudo, got %q, %v", payload, pr.SnkStdout, pr.Err)
+	}
+
+	l.Password = "wrong"
+	_, _, err = piper.RunCmdStrInCapture(l, "cat", payload)
+	if !errors.Is(err, piper.ErrPasswordRejected) {
+		t.Errorf("expected password rejected error, got %v", err)
+	}
+
+	l.Method = piper.MethodDoas
+	if _, err := l.Launch("true"); err == nil {
+		t.Errorf("doas accepted a password")
+	}
+}
+
+// fakeRuntime stands in for a container CLI such as docker(1).  It runs
+// the command itself, with FAKE_CONTAINER and FAKE_CONTAINER_USER set to
+// the container and -u argument.
+const fakeRuntime = `#!/bin/sh
+[ "$1" = exec ] || exit 125
+shift
+FAKE_CONTAINER_USER=
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-i) shift ;;
+	-u) FAKE_CONTAINER_USER=$2; shift 2 ;;
+	-w) cd "$2" || exit 126; shift 2 ;;
+	*) break ;;
+	esac
+done
+FAKE_CONTAINER=$1
+shift
+export FAKE_CONTAINER FAKE_CONTAINER_USER
+exec "$@"
+`
+
+// FakeRuntime puts a fake container CLI named fakectr first in our PATH
+// for the duration of the test; see ContainerExecTest.
+func FakeRuntime(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "fakectr"), []byte(fakeRuntime), 0755); err != nil {
+		t.Fatalf("error writing fake container runtime: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// ContainerExecTest verifies that ContainerExec runs commands in the right
+// container as the right user with their streams intact, and that errors
+// and Command describe the command as given.  lch's host must have a
+// fakectr like the one FakeRuntime provides.
+func ContainerExecTest(t *testing.T, lch piper.Launcher) {
+	l := piper.ContainerExec{Launcher: lch, Runtime: "fakectr", Container: "web'1", User: "www", Args: []string{"-w", "/"}}
+	cmd := `echo "$FAKE_CONTAINER" "$FAKE_CONTAINER_USER" "$(pwd)" 'a b'; echo err >&2; cat`
+	stdout, stderr, err := piper.RunCmdStrInCapture(l, cmd, "in\n")
+	if err != nil {
+		t.Errorf("error running in container: %v", err)
+	}
+	if want := "web'1 www / a b\nin\n"; stdout != want || stderr != "err\n" {
+		t.Errorf("expected stdout %q and stderr %q, got %q and %q", want, "err\n", stdout, stderr)
+	}
+
+	exe, err := l.Launch("exit 3")
+	if err != nil {
+		t.Fatalf("error launching: %v", err)
+	}
+	if exe.Command() != "exit 3" {
+		t.Errorf("expected command %q, got %q", "exit 3", exe.Command())
+	}
+	err = exe.Run()
+	if piper.ExitStatus(err) != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+	if err == nil || !strings.Contains(exe.Errorf("x").Error(), "{exit 3}") {
+		t.Errorf("expected error to give the command as given, got %v", exe.Errorf("x"))
+	}
+
+	pr := piper.Pipe(piper.Launchable{Launcher: l, Cmd: "echo hello"}, piper.Launchable{Launcher: l, Cmd: "tr a-z A-Z"})
+	if pr.Err != nil || pr.SnkStdout != "HELLO\n" {
+		t.Errorf("expected HELLO piped between containers, got %q, %v", pr.SnkStdout, pr.Err)
+	}
+	// Wrapping shouldn't stop commands being connected by an OS pipe.
+	if exe, err := lch.Launch("true"); err == nil {
+		if _, ok := exe.(piper.FileExecutor); ok && !pr.OSPipe {
+			t.Errorf("expected an OS pipe between containers")
+		}
+	}
+
+	if _, err := (piper.ContainerExec{Launcher: lch}).Launch("true"); err == nil {
+		t.Errorf("expected error for missing container")
+	}
+}
+
+// TranscriptTest verifies that a Transcript records output from both
+// streams in order, alongside the separate captures, and that CaptureLimit
+// bounds it.
+func TranscriptTest(t *testing.T, lch piper.Launcher) {
+	cmd := "echo out1; sleep 0.2; echo err1 >&2; sleep 0.2; echo out2"
+	rr := piper.RunCmdWith(lch, cmd, piper.RunOptions{Capture: true, Transcript: true})
+	if rr.Err != nil {
+		t.Fatalf("error running: %v", rr.Err)
+	}
+	if rr.Stdout != "out1\nout2\n" || rr.Stderr != "err1\n" {
+		t.Errorf("expected separate captures, got %q and %q", rr.Stdout, rr.Stderr)
+	}
+	want := []piper.Chunk{{Stream: piper.StreamStdout, Data: "out1\n"},
+		{Stream: piper.StreamStderr, Data: "err1\n"}, {Stream: piper.StreamStdout, Data: "out2\n"}}
+	chunks := rr.Transcript.Chunks
+	if len(chunks) != len(want) {
+		t.Fatalf("expected %d chunks, got %+v", len(want), chunks)
+	}
+	for i, c := range chunks {
+		if c.Stream != want[i].Stream || c.Data != want[i].Data {
+			t.Errorf("chunk %d: expected %s %q, got %s %q", i, want[i].Stream, want[i].Data, c.Stream, c.Data)
+		}
+		if i > 0 && c.Time.Before(chunks[i-1].Time) {
+			t.Errorf("chunk %d is timestamped before chunk %d", i, i-1)
+		}
+	}
+	if got := rr.Transcript.String(); got != "out1\nerr1\nout2\n" {
+		t.Errorf("expected combined output, got %q", got)
+	}
+
+	rr = piper.RunCmdWith(lch, "printf aaaa; sleep 0.2; printf bbbb >&2; sleep 0.2; printf cccc",
+		piper.RunOptions{Transcript: true, CaptureLimit: 2})
+	if rr.Err != nil {
+		t.Fatalf("error running: %v", rr.Err)
+	}
+	if rr.Stdout != "" || rr.Stderr != "" {
+		t.Errorf("expected no separate captures, got %q and %q", rr.Stdout, rr.Stderr)
+	}
+	if tr := rr.Transcript; tr.Dropped != 8 || tr.String() != "aa\n[... 8 bytes dropped ...]\ncc" {
+		t.Errorf("expected head and tail with 8 bytes dropped, got %+v", tr)
+	}
+}
+
+// ScanTest verifies that ScanCmd yields records as they arrive, splits on
+// the delimiter given, reports failures after the last record, and kills
+// commands that are abandoned.
+func ScanTest(t *testing.T, lch piper.Launcher) {
+	scan := func(cmd string, opts piper.ScanOptions) ([]string, *piper.Scanner) {
+		s, err := piper.ScanCmd(lch, cmd, opts)
+		if err != nil {
+			t.Fatalf("error starting %q: %v", cmd, err)
+		}
+		var recs []string
+		for s.Next() {
+			recs = append(recs, s.Text())
+		}
+		return recs, s
+	}
+
+	recs, s := scan("printf 'a\\nb c\\n\\nd'", piper.ScanOptions{})
+	if want := []string{"a", "b c", "", "d"}; !reflect.DeepEqual(recs, want) || s.Err() != nil {
+		t.Errorf("expected %q, got %q, %v", want, recs, s.Err())
+	}
+	stdin := "x\x00y\ny\x00"
+	recs, s = scan("cat", piper.ScanOptions{Delim: "\x00", Stdin: &stdin})
+	if want := []string{"x", "y\ny"}; !reflect.DeepEqual(recs, want) || s.Close() != nil {
+		t.Errorf("expected %q, got %q, %v", want, recs, s.Err())
+	}
+
+	recs, s = scan("echo a; echo oops >&2; exit 3", piper.ScanOptions{})
+	if piper.ExitStatus(s.Err()) != 3 || len(recs) != 1 || s.Stderr() != "oops\n" {
+		t.Errorf("expected one record, exit status 3 and stderr, got %q, %v, %q", recs, s.Err(), s.Stderr())
+	}
+	if s.Close() != s.Err() {
+		t.Errorf("expected Close to return Err")
+	}
+
+	recs, s = scan("head -c 100 /dev/zero; echo", piper.ScanOptions{MaxRecord: 10})
+	if s.Err() == nil || len(recs) != 0 {
+		t.Errorf("expected error for oversized record, got %q, %v", recs, s.Err())
+	}
+
+	// Records should be available while the command runs, and abandoning
+	// it should kill it rather than waiting.
+	start := time.Now()
+	s, err := piper.ScanCmd(lch, "echo first; sleep 10; echo second", piper.ScanOptions{})
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	if !s.Next() || s.Text() != "first" {
+		t.Errorf("expected first record, got %q, %v", s.Text(), s.Err())
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("error closing: %v", err)
+	}
+	if s.Next() {
+		t.Errorf("expected no records after Close")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %v to abandon command", d)
+	}
+
+	s, err = piper.ScanCmd(lch, "yes", piper.ScanOptions{})
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	// Read a few records of the endless output, then abandon it.
+	n := 0
+	for n < 3 && s.Next() {
+		if s.Text() != "y" {
+			t.Errorf("expected record %q, got %q", "y", s.Text())
+		}
+		n++
+	}
+	if n != 3 {
+		t.Errorf("expected 3 records before abandoning yes, got %d: %v", n, s.Err())
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("expected to abandon yes cleanly, got %v", err)
+	}
+
+	// A command that fails to start must still be released.
+	tl := newTrackingLauncher(lch, 1)
+	if _, err := piper.ScanCmd(tl, "true", piper.ScanOptions{Stdin: &stdin}); !piper.IsStartError(err) {
+		t.Errorf("expected StartError, got %v", err)
+	}
+	if n := atomic.LoadInt32(tl.outstanding); n != 0 {
+		t.Errorf("expected the executor released, got %d outstanding", n)
+	}
+}
+
+// JSONTest verifies that RunCmdJSON and ScanCmdJSON decode command output,
+// and that their errors describe the command and include its stderr.
+func JSONTest(t *testing.T, lch piper.Launcher) {
+	type rec struct {
+		A int      `json:"a"`
+		B []string `json:"b"`
+	}
+	var r rec
+	if err := piper.RunCmdJSON(lch, `echo '{"a": 1, "b": ["x"]}'`, &r); err != nil || r.A != 1 || len(r.B) != 1 {
+		t.Errorf("expected a=1 b=[x], got %+v, %v", r, err)
+	}
+	for _, cmd := range []string{"echo not json; echo warning >&2", "echo warning >&2", `echo '{}' '{}'; echo warning >&2`} {
+		err := piper.RunCmdJSON(lch, cmd, &r)
+		if err == nil || !strings.Contains(err.Error(), cmd) || !strings.Contains(err.Error(), "warning") {
+			t.Errorf("%q: expected error giving command and stderr, got %v", cmd, err)
+		}
+	}
+	if err := piper.RunCmdJSON(lch, `echo '{}'; echo failed >&2; exit 3`, &r); piper.ExitStatus(err) != 3 || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("expected exit status 3 and stderr, got %v", err)
+	}
+
+	js, err := piper.ScanCmdJSON(lch, `printf '{"a": 1}\n\n{"a": 2}\n{"a": 3}'`, piper.ScanOptions{})
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	var as []int
+	for {
+		var r rec
+		if err = js.Decode(&r); err != nil {
+			break
+		}
+		as = append(as, r.A)
+	}
+	if err != io.EOF || !reflect.DeepEqual(as, []int{1, 2, 3}) {
+		t.Errorf("expected 1 2 3 then EOF, got %v, %v", as, err)
+	}
+	if err := js.Close(); err != nil {
+		t.Errorf("error closing: %v", err)
+	}
+
+	js, err = piper.ScanCmdJSON(lch, `echo '{"a": 1}'; echo oops; echo bad >&2; sleep 10`, piper.ScanOptions{})
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	if err := js.Decode(&r); err != nil {
+		t.Errorf("error decoding first record: %v", err)
+	}
+	err = js.Decode(&r)
+	if err == nil || !strings.Contains(err.Error(), "record 2") || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("expected error for record 2 with stderr, got %v", err)
+	}
+	if js.Close() != err {
+		t.Errorf("expected Close to return the decoding error")
+	}
+
+	js, err = piper.ScanCmdJSON(lch, `yes '{"a": 1}'`, piper.ScanOptions{})
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	if err := js.Decode(&r); err != nil {
+		t.Errorf("error decoding: %v", err)
+	}
+	if err := js.Close(); err != nil {
+		t.Errorf("expected to abandon yes cleanly, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package piper
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Streams a Chunk can come from.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+type (
+	// Chunk is output read from one of a command's streams.
+	Chunk struct {
+		// Stream is StreamStdout or StreamStderr.
+		Stream string
+		// Time is when we read the chunk.
+		Time time.Time
+		Data string
+	}
+
+	// Transcript is a command's output from both streams, in the order we
+	// read it.  Since the streams are separate pipes, output written to
+	// both at nearly the same time may appear in either order, but output
+	// separated by a pause won't be reordered.
+	Transcript struct {
+		Chunks []Chunk
+		// Dropped counts the bytes left out of the middle due to
+		// RunOptions.CaptureLimit, and DroppedAt is the index of the chunk
+		// they'd have preceded.
+		Dropped   int64
+		DroppedAt int
+	}
+
+	// transcriber records a Transcript from writes to both streams.  If
+	// limit is positive, only the first and last limit bytes are kept, as
+	// for capture.
+	transcriber struct {
+		mu    sync.Mutex
+		limit int
+		head  []Chunk
+		nhead int
+		// tail holds the most recent chunks written after head filled up,
+		// amounting to at most limit bytes.
+		tail    []Chunk
+		ntail   int
+		dropped int64
+	}
+
+	// streamWriter writes to a transcriber as one stream.
+	streamWriter struct {
+		t      *transcriber
+		stream string
+	}
+)
+
+func newTranscriber(limit int) *transcriber {
+	return &transcriber{limit: limit}
+}
+
+// writer returns a writer recording chunks from stream.
+func (t *transcriber) writer(stream string) io.Writer {
+	return streamWriter{t, stream}
+}
+
+// Write implements io.Writer.
+func (w streamWriter) Write(p []byte) (int, error) {
+	w.t.add(Chunk{Stream: w.stream, Time: time.Now(), Data: string(p)})
+	return len(p), nil
+}
+
+// add records c.
+func (t *transcriber) add(c Chunk) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limit <= 0 {
+		t.head = append(t.head, c)
+		return
+	}
+
+	if room := t.limit - t.nhead; room > 0 {
+		hc := c
+		if room < len(c.Data) {
+			hc.Data = c.Data[:room]
+		}
+		t.head = append(t.head, hc)
+		t.nhead += len(hc.Data)
+		c.Data = c.Data[len(hc.Data):]
+		if c.Data == "" {
+			return
+		}
+	}
+
+	t.tail = append(t.tail, c)
+	t.ntail += len(c.Data)
+	// Drop the oldest tail bytes beyond the limit.
+	for t.ntail > t.limit {
+		excess := t.ntail - t.limit
+		if oldest := &t.tail[0]; len(oldest.Data) > excess {
+			oldest.Data = oldest.Data[excess:]
+			t.ntail -= excess
+			t.dropped += int64(excess)
+		} else {
+			t.ntail -= len(oldest.Data)
+			t.dropped += int64(len(oldest.Data))
+			t.tail = t.tail[1:]
+		}
+	}
+}
+
+// transcript returns what's been recorded.
+func (t *transcriber) transcript() Transcript {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	chunks := make([]Chunk, 0, len(t.head)+len(t.tail))
+	chunks = append(append(chunks, t.head...), t.tail...)
+	return Transcript{Chunks: chunks, Dropped: t.dropped, DroppedAt: len(t.head)}
+}
+
+// String returns the output of both streams combined, as if the command
+// had been run with 2>&1, with a marker standing in for any dropped bytes.
+func (t Transcript) String() string {
+	var b strings.Builder
+	for i, c := range t.Chunks {
+		if t.Dropped > 0 && i == t.DroppedAt {
+			fmt.Fprintf(&b, "\n[... %d bytes dropped ...]\n", t.Dropped)
+		}
+		b.WriteString(c.Data)
+	}
+	return b.String()
+}
+
+// teeWriter returns a writer writing to both w, if non-nil, and tw.
+func teeWriter(w, tw io.Writer) io.Writer {
+	if w == nil {
+		return tw
+	}
+	return io.MultiWriter(w, tw)
+}